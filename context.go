@@ -0,0 +1,150 @@
+package luar
+
+// Context-aware execution of Lua code.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// Number of Lua instructions between two checks of the context.
+const cContextHookCount = 1000
+
+// loadError pops the error of a failed L.LoadString or L.LoadFile.
+func loadError(L *lua.State) error {
+	e := &LuaError{Message: L.ToString(-1)}
+	L.Pop(1)
+	return e
+}
+
+// interruptError is raised by the hook of withContext once 'ctx' is done.
+type interruptError struct {
+	ctx context.Context
+}
+
+func (e *interruptError) Error() string {
+	return "execution interrupted"
+}
+
+func (e *interruptError) Unwrap() error {
+	return e.ctx.Err()
+}
+
+var (
+	// contextHooks holds the interruptions checked by the hook of the states
+	// running withContext, outermost first.
+	contextHooks   = map[*lua.State][]*interruptError{}
+	contextHooksmu sync.Mutex
+)
+
+// setContextHook sets the hook of L raising the first of 'interrupts' whose
+// context is done.
+func setContextHook(L *lua.State, interrupts []*interruptError) {
+	L.SetHook(func(L *lua.State) {
+		for _, interrupt := range interrupts {
+			select {
+			case <-interrupt.ctx.Done():
+				raiseGoError(L, interrupt)
+			default:
+			}
+		}
+	}, cContextHookCount)
+}
+
+// withContext runs 'f' with a debug hook that raises a Lua error once 'ctx' is
+// done. Calls can be nested: the hook of the enclosing call is restored
+// afterwards, or cleared at the outermost call. The returned error wraps
+// ctx.Err() if the execution was interrupted by this hook.
+func withContext(ctx context.Context, L *lua.State, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// The context can never be canceled.
+		return f()
+	}
+
+	interrupt := &interruptError{ctx: ctx}
+	contextHooksmu.Lock()
+	outer := contextHooks[L]
+	interrupts := append(outer[:len(outer):len(outer)], interrupt)
+	contextHooks[L] = interrupts
+	contextHooksmu.Unlock()
+	setContextHook(L, interrupts)
+	defer func() {
+		contextHooksmu.Lock()
+		if len(outer) == 0 {
+			delete(contextHooks, L)
+		} else {
+			contextHooks[L] = outer
+		}
+		contextHooksmu.Unlock()
+		if len(outer) == 0 {
+			// golua cannot return the previous hook: clear it, a zero count
+			// disables the hook.
+			L.SetHook(func(L *lua.State) {}, 0)
+		} else {
+			setContextHook(L, outer)
+		}
+	}()
+
+	err := f()
+	var ierr *interruptError
+	if err != nil && errors.As(err, &ierr) && ierr == interrupt {
+		if e, ok := err.(*LuaError); ok {
+			e.Err = ctx.Err()
+			return e
+		}
+		return fmt.Errorf("%v: %w", err, ctx.Err())
+	}
+	return err
+}
+
+// CallContext is like Call but the Lua execution is interrupted with an error
+// once 'ctx' is done. The returned error then wraps ctx.Err().
+//
+// The context is checked every few Lua instructions: Go functions called from
+// Lua are not interrupted.
+//
+// The check uses the debug hook of the state. Nested calls on the same state
+// also check the contexts of the enclosing calls, whose hook is restored
+// afterwards. Since golua cannot return the current hook, a hook set with
+// L.SetHook or L.SetExecutionLimit is replaced during the outermost call and
+// cleared afterwards: set it again if needed. The hook is only installed on the
+// state of the call, so that coroutines resumed during the call are not
+// interrupted.
+func (lo *LuaObject) CallContext(ctx context.Context, results interface{}, args ...interface{}) error {
+	return withContext(ctx, lo.l, func() error {
+		return lo.Call(results, args...)
+	})
+}
+
+// DoFileContext is like L.DoFile but the execution is interrupted once 'ctx'
+// is done. Errors are returned as *LuaError.
+//
+// See LuaObject.CallContext.
+func DoFileContext(ctx context.Context, L *lua.State, filename string) error {
+	return withContext(ctx, L, func() error {
+		if L.LoadFile(filename) != 0 {
+			return loadError(L)
+		}
+		return pcall(L, 0, lua.LUA_MULTRET)
+	})
+}
+
+// DoStringContext is like L.DoString but the execution is interrupted once
+// 'ctx' is done. Errors are returned as *LuaError.
+//
+// See LuaObject.CallContext.
+func DoStringContext(ctx context.Context, L *lua.State, code string) error {
+	return withContext(ctx, L, func() error {
+		if L.LoadString(code) != 0 {
+			return loadError(L)
+		}
+		return pcall(L, 0, lua.LUA_MULTRET)
+	})
+}
@@ -0,0 +1,195 @@
+package luar
+
+// Lua coroutines driven from Go.
+
+import (
+	"errors"
+	"runtime"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+var (
+	// ErrCoroutineDead is returned when resuming a coroutine that has
+	// returned, failed or been closed.
+	ErrCoroutineDead = errors.New("cannot resume dead coroutine")
+	// ErrCoroutineRunning is returned when resuming a coroutine that is
+	// running or that is resuming another coroutine.
+	ErrCoroutineRunning = errors.New("cannot resume non-suspended coroutine")
+)
+
+// CoroutineStatus is the status of a coroutine, as returned by Lua's
+// 'coroutine.status'.
+type CoroutineStatus int
+
+const (
+	// CoroutineSuspended is the status of a coroutine that has not started or
+	// that has yielded.
+	CoroutineSuspended CoroutineStatus = iota
+	// CoroutineRunning is the status of a coroutine that is running, or that
+	// is resuming another coroutine.
+	CoroutineRunning
+	// CoroutineDead is the status of a coroutine that has returned, failed or
+	// been closed.
+	CoroutineDead
+)
+
+func (s CoroutineStatus) String() string {
+	switch s {
+	case CoroutineSuspended:
+		return "suspended"
+	case CoroutineRunning:
+		return "running"
+	}
+	return "dead"
+}
+
+// Coroutine is a Lua coroutine that can be resumed from Go.
+//
+// The coroutine runs in its own Lua thread, which shares the globals of the
+// state of the function it was created from.
+type Coroutine struct {
+	l      *lua.State
+	thread *lua.State
+	ref    int
+	dead   bool
+	// tracker releases the reference when the coroutine is garbage-collected,
+	// if not nil.
+	tracker *objectTracker
+}
+
+// NewCoroutine creates a coroutine running the function 'lo'. The coroutine
+// starts suspended: the first call to Resume passes its arguments to the
+// function.
+func NewCoroutine(lo *LuaObject) (*Coroutine, error) {
+	L := lo.l
+	lo.Push()
+	defer L.Pop(1)
+	if !L.IsFunction(-1) {
+		return nil, ErrLuaObjectCallable
+	}
+	T := L.NewThread()
+	// The registry reference keeps the thread from being collected.
+	ref := L.Ref(lua.LUA_REGISTRYINDEX)
+	L.PushValue(-1)
+	L.XMove(T, 1)
+	return newCoroutine(L, T, ref), nil
+}
+
+// newCoroutine creates a coroutine of the thread T, referenced by 'ref' in the
+// registry of L.
+func newCoroutine(L, T *lua.State, ref int) *Coroutine {
+	co := &Coroutine{l: L, thread: T, ref: ref}
+	if co.tracker = trackRef(L, ref); co.tracker != nil {
+		runtime.SetFinalizer(co, func(co *Coroutine) { co.tracker.finalize(co.ref) })
+	}
+	return co
+}
+
+// newCoroutineFromThread creates a coroutine from the thread at 'idx'.
+func newCoroutineFromThread(L *lua.State, idx int) *Coroutine {
+	T := L.ToThread(idx)
+	L.PushValue(idx)
+	ref := L.Ref(lua.LUA_REGISTRYINDEX)
+	return newCoroutine(L, T, ref)
+}
+
+// Close releases the coroutine. It cannot be resumed afterwards.
+func (co *Coroutine) Close() {
+	if co.ref == lua.LUA_NOREF {
+		return
+	}
+	co.thread.SetTop(0)
+	co.l.Unref(lua.LUA_REGISTRYINDEX, co.ref)
+	if co.tracker != nil {
+		runtime.SetFinalizer(co, nil)
+	}
+	untrackRef(co.l, co.ref, co.tracker)
+	co.ref, co.tracker = lua.LUA_NOREF, nil
+	co.dead = true
+}
+
+// Resume starts or continues the execution of the coroutine. The first call
+// passes 'args' to the function, the following ones pass them as the results
+// of 'coroutine.yield'.
+//
+// The values passed to 'coroutine.yield', or returned by the function when it
+// ends, are stored in 'results' as described in LuaObject.Call. Use Status to
+// tell whether the coroutine yielded or ended.
+//
+// Errors raised in the coroutine are returned as *LuaError, and the coroutine
+// is dead afterwards. Resuming a dead coroutine returns ErrCoroutineDead.
+func (co *Coroutine) Resume(results interface{}, args ...interface{}) error {
+	push := func(T *lua.State) int {
+		for _, arg := range args {
+			GoToLuaProxy(T, arg)
+		}
+		return len(args)
+	}
+	return co.resume(push, func(T *lua.State, n int) error {
+		return storeResults(T, 1, n, results)
+	})
+}
+
+// resume is like Resume but the arguments are pushed by 'push', which returns
+// their number, and the 'n' results on the stack of the thread are handled by
+// 'collect'.
+func (co *Coroutine) resume(push func(T *lua.State) int, collect func(T *lua.State, n int) error) (err error) {
+	if co.Status() != CoroutineSuspended {
+		if co.Status() == CoroutineRunning {
+			return ErrCoroutineRunning
+		}
+		return ErrCoroutineDead
+	}
+	releaseObjects(co.l)
+	T := co.thread
+	nargs := push(T)
+
+	defer func() {
+		// Go errors raised in the coroutine propagate as panics.
+		if r := recover(); r != nil {
+			rerr, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			co.dead = true
+			err = newGoLuaError(rerr)
+		}
+	}()
+
+	switch T.Resume(nargs) {
+	case 0, lua.LUA_YIELD:
+	default:
+		co.dead = true
+		e := &LuaError{Message: luaErrorMessage(T, -1), Err: errorOfProxy(T, -1)}
+		// The stack of a failed coroutine is left as is.
+		e.setStack(T.StackTrace())
+		T.SetTop(0)
+		return e
+	}
+
+	defer T.SetTop(0)
+	return collect(T, T.GetTop())
+}
+
+// Status returns the status of the coroutine.
+func (co *Coroutine) Status() CoroutineStatus {
+	if co.dead {
+		return CoroutineDead
+	}
+	T := co.thread
+	switch T.Status() {
+	case lua.LUA_YIELD:
+		return CoroutineSuspended
+	case 0:
+		if len(T.StackTrace()) > 0 {
+			return CoroutineRunning
+		}
+		if T.GetTop() == 0 {
+			// The function has returned.
+			return CoroutineDead
+		}
+		return CoroutineSuspended
+	}
+	return CoroutineDead
+}
@@ -27,6 +27,49 @@ is converted to a Go map.
 
 Pointer values encode as the value pointed to when unproxified.
 
+Values which cannot be modified in place, such as map values or structs stored
+in interfaces, are proxied as copies. Modifications through such proxies,
+including calls to methods with a pointer receiver, are written back to the
+parent map, slice or struct, e.g. 'm.key.Field = 1' updates 'm["key"]'. A copy
+is no longer written back once its entry is deleted or replaced, e.g. by
+another copy.
+
+A Go function panicking with an error raises a Lua error. The 'pcall' function
+installed by Init returns it as a proxy of the Go error, with its 'Error'
+method. Errors returned by LuaObject.Call wrap the original Go error, so that
+errors.Is and errors.As work across Lua code.
+
+The error returned as last result by a Go function is pushed like other
+results by default. See ErrorPolicy for the Lua conventions 'nil, message' and
+raising the error instead.
+
+A LuaObject holds a reference to its Lua value until Close is called. Objects
+which are never closed, e.g. created implicitly by LuaToGo, can be released
+when garbage-collected with SetAutoRelease and reported with SetLeakTracking.
+Their bookkeeping is dropped when the state is closed.
+
+The generic functions Get, Call and CallMulti, and the Table type, convert the
+values of LuaObjects to Go types without pointers, e.g.
+'luar.Get[int](config, "port")'. LuaObject.All and LuaObject.IPairs iterate
+with 'for range'. They require Go 1.23.
+
+Lua functions can be run as coroutines stepped from Go with NewCoroutine:
+Resume returns the values passed to 'coroutine.yield' like LuaObject.Call
+returns results. Lua coroutines converted to Go values are Coroutine objects;
+like the LuaObjects created by conversions, they hold a reference to the
+thread until they are closed.
+
+Go functions wrapped with EventLoop.Async run in their own goroutine while the
+calling coroutine is suspended; the event loop resumes it with their results.
+Since Lua 5.1 cannot yield across Go or C functions, async functions cannot be
+called through 'pcall', including the one installed by Init, or from
+metamethods.
+
+Proxies have a stable identity: pushing the same pointer, map, channel or
+addressable value several times to a Lua state yields the same userdata, as
+long as it is referenced in Lua. Proxies can thus be compared with 'rawequal'
+and used as table keys.
+
 Usual operators (arithmetic, string concatenation, pairs/ipairs, etc.) work on
 proxies too. The type of the result depends on the type of the operands. The
 rules are as follows:
@@ -38,6 +81,37 @@ rules are as follows:
 - If the types are different and not Lua numbers, convert to a complex proxy, a
 Lua number, or a Lua string according to the result kind.
 
+Number proxies also support the Lua 5.3 integer division, bitwise and shift
+operators ('//', '&', '|', '~', '<<' and '>>') with Go integer semantics:
+division truncates towards zero and shifts by a negative amount raise an
+error. Since Lua 5.1 lacks these operators, the same operations are available
+as 'luar.idiv', 'luar.band', 'luar.bor', 'luar.bxor', 'luar.bnot', 'luar.shl'
+and 'luar.shr' when using Init.
+
+Proxies of types with a 'Compare(T) int' or 'Less(T) bool' method can be
+ordered with '<', '<=', '>' and '>='. Equality uses the 'Equal(T) bool' or
+'Compare(T) int' method when available. Otherwise comparable values are compared
+with Go's '==', maps, slices and functions are compared by identity, and other
+values are compared with reflect.DeepEqual.
+
+
+Access policy
+
+Expose and Hide restrict the fields and methods of a type that Lua can
+access, and SetAccessFilter installs a function deciding for any type.
+Inaccessible fields and methods behave as if they did not exist. The rules
+apply to every value of the type, including values reached from other proxies
+or returned by Go functions, members promoted to structs embedding the type,
+struct copies and tables converted to the type.
+
+
+Read-only proxies
+
+GoToLuaReadOnly and RegisterReadOnly push proxies that can be inspected but
+not modified from Lua: setting fields and elements, appending, sending to or
+closing channels and calling methods with a pointer receiver raise an error.
+Fields, elements and values reached from a read-only proxy are read-only too.
+
 
 Channels
 
@@ -45,10 +119,33 @@ Channel proxies can be manipulated with the following methods:
 
 - close(): Close the channel.
 
-- recv() value: Fetch and return a value from the channel.
+- recv() (value, ok boolean): Fetch and return a value from the channel. As in
+Go, 'ok' is false and 'value' is nil if the channel is closed.
+
+- recv_timeout(seconds number) (value, ok boolean): Like recv, but give up after
+the timeout. 'ok' is nil on timeout.
 
 - send(x value): Send a value in the channel.
 
+- try_recv() (value, ok boolean): Like recv, but do not block. 'ok' is nil if no
+value is ready.
+
+- try_send(x value) boolean: Send a value in the channel if it does not block.
+Return whether the value was sent.
+
+- values() function: Return an iterator receiving values until the channel is
+closed, for use in generic 'for' loops. Since the loop ends on nil, prefer
+pairs/ipairs for channels that may carry nil values.
+
+Channel proxies can be browsed with the pairs/ipairs functions which, like Go's
+'for v := range ch', receive values until the channel is closed. The index
+counts the received values, starting from 1.
+
+The luar.select function (see ChanSelect) multiplexes channel operations like
+Go's 'select' statement:
+
+	local i, v, ok = luar.select{ {ch1, "recv"}, {ch2, "send", x}, default = fn }
+
 
 Complex numbers
 
@@ -59,6 +156,44 @@ Complex proxies can be manipulated with the following attributes:
 - imag: The imaginary part.
 
 
+Maps
+
+Assigning nil to a key of a map proxy deletes it. Assign 'luar.null' to store
+the zero value instead.
+
+Map proxies can be manipulated with the following methods, which are only
+available through 'luar.method' so that they never collide with the keys, e.g.
+'luar.method(m, "keys")()':
+
+- clear(): Delete all the keys.
+
+- delete(k key): Delete the key.
+
+- has(k key) boolean: Whether the key is present.
+
+- keys() table: Return the keys as an array.
+
+- table() table: Return a shallow copy of the map as a table. Use
+'luar.unproxify' for a deep copy.
+
+- values() table: Return the values as an array.
+
+
+References
+
+Pointers to booleans, numbers and strings of predeclared types, e.g. '*int', are
+passed as reference proxies so that Lua can modify the value they point to:
+
+- get() value: Return the value.
+
+- set(x value): Set the value. It must be convertible to the pointed type.
+
+- value: The value, which can also be assigned.
+
+The luar.ref function (see MakeRef) creates references from Lua, to be passed as
+out-parameters to Go functions taking pointers.
+
+
 Slices
 
 Slice proxies can be manipulated with the following methods/attributes:
@@ -71,6 +206,36 @@ slice. The elements must be convertible to the slice element type.
 - slice(i, j integer) sliceProxy: Return the sub-slice that ranges from 'i' to 'j'
 excluded, starting from 1.
 
+Assigning to the index following the last element appends to the slice if it
+can be set, that is if it is reached from a pointer, e.g. the field of a struct
+proxy or a proxy to a pointer to a slice. The grown slice is written back so
+that Go sees the new length. Other slices raise an "index out of range" error.
+
+Slices also have methods mirroring Lua's table library. They accept both the dot
+and the colon call syntax. As with 'append', the methods changing the length
+return the new slice:
+
+- concat([sep string [, i [, j integer]]]) string: Like table.concat. The
+elements must be numbers or strings.
+
+- copy() sliceProxy: Return a copy of the slice with its own backing array.
+
+- find(x value [, init integer]) integer: Return the index of the first element
+equal to 'x', or nil.
+
+- insert([pos integer,] x value) sliceProxy: Insert 'x' at 'pos', or at the end.
+
+- remove([pos integer]) (sliceProxy, value): Remove the element at 'pos', or the
+last one. Return the new slice and the removed element.
+
+- reverse(): Reverse the slice in place.
+
+- sort([comp function]): Sort the slice in place. Without 'comp', numbers and
+strings are compared with '<' and other values as described in the comparison
+rules above.
+
+Go methods with the same names are shadowed; use luar.method to call them.
+
 
 Strings
 
@@ -78,12 +243,46 @@ String proxies can be browsed rune by rune with the pairs/ipairs functions.
 These runes are encoded as strings in Lua.
 
 Indexing a string proxy (starting from 1) will return the corresponding byte as
-a Lua string.
+a Lua string. The length operator '#' returns the number of bytes.
 
-String proxies can be manipulated with the following method:
+In short, indexing, '#' and 'slice' count bytes, as in Go, while iteration
+counts runes, as 'range' does in Go. Invalid UTF-8 bytes count as one rune each.
 
-- slice(i, j integer) sliceProxy: Return the sub-string that ranges from 'i' to 'j'
-excluded, starting from 1.
+String proxies can be manipulated with the following methods:
+
+- bytes() table: Return the bytes of the string as a table of integers.
+
+- runelen() integer: Return the number of runes.
+
+- runes() table: Return the runes of the string as a table of strings.
+
+- runeslice(i [, j integer]) stringProxy: Return the sub-string that ranges from
+rune 'i' to rune 'j' excluded, or to the end, starting from 1.
+
+- slice(i, j integer) sliceProxy: Return the sub-string that ranges from byte
+'i' to byte 'j' excluded, starting from 1.
+
+The functions of Lua's string library can be called as methods on string
+proxies, e.g. 's:upper()' or 's:find("x")', like on Lua strings. The proxy is
+passed as a Lua string. The first result of gsub, lower, rep, reverse, sub and
+upper is returned as a proxy of the same type as 's'. Go methods take
+precedence.
+
+
+Structs
+
+Fields of struct proxies can be indexed by their name or by their "lua" tag,
+including the fields promoted from embedded structs.
+
+Struct proxies can be browsed with the pairs function, which yields the
+exported fields in declaration order, promoted fields following their embedded
+field. Keys are the "lua" tags if any, the field names otherwise. Composite
+values are proxies, as when indexing.
+
+The luar.fields function (see ProxyFields) iterates in the same way and can
+include the methods after the fields:
+
+	for name, value in luar.fields(s, true) do print(name, value) end
 
 */
 package luar
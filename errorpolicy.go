@@ -0,0 +1,72 @@
+package luar
+
+// Error-return convention of Go functions called from Lua.
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrorPolicy defines how a Go function called from Lua reports the error it
+// returns as last result.
+type ErrorPolicy int
+
+const (
+	// ErrorPassThrough pushes the error like any other result. This is the
+	// default.
+	ErrorPassThrough ErrorPolicy = iota
+	// ErrorReturn returns 'nil, message' if the error is not nil, the other
+	// results otherwise. This is the Lua convention, e.g. 'assert(f())'.
+	ErrorReturn
+	// ErrorRaise raises the error if it is not nil, as if the function had
+	// panicked with it, and returns the other results otherwise.
+	ErrorRaise
+)
+
+var (
+	errorPolicy   = ErrorPassThrough
+	errorPolicymu sync.RWMutex
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// policyFunc is a function with its own error policy.
+type policyFunc struct {
+	f      interface{}
+	policy ErrorPolicy
+}
+
+// SetErrorPolicy sets the error policy of the Go functions which do not have
+// their own policy. It applies to functions already pushed to Lua.
+func SetErrorPolicy(p ErrorPolicy) {
+	errorPolicymu.Lock()
+	defer errorPolicymu.Unlock()
+	errorPolicy = p
+}
+
+// WithErrorPolicy returns the function 'f' with the error policy 'p', to be
+// pushed to Lua, e.g. with Register:
+//
+//	luar.Register(L, "", luar.Map{
+//		"open": luar.WithErrorPolicy(os.Open, luar.ErrorReturn),
+//	})
+//
+// It panics if 'f' is not a function.
+func WithErrorPolicy(f interface{}, p ErrorPolicy) interface{} {
+	if reflect.TypeOf(f).Kind() != reflect.Func {
+		panic(fmt.Sprintf("luar: WithErrorPolicy requires a function, got %T", f))
+	}
+	return policyFunc{f: f, policy: p}
+}
+
+// currentErrorPolicy returns the error policy of a function with policy 'p',
+// or the global policy if 'p' is nil.
+func currentErrorPolicy(p *ErrorPolicy) ErrorPolicy {
+	if p != nil {
+		return *p
+	}
+	errorPolicymu.RLock()
+	defer errorPolicymu.RUnlock()
+	return errorPolicy
+}
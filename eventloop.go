@@ -0,0 +1,293 @@
+package luar
+
+// Asynchronous Go functions suspending the calling coroutine.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// ErrYieldOutsideAsync is returned by EventLoop.Spawn and EventLoop.Run when a
+// coroutine of the loop yields other than by calling an async function.
+var ErrYieldOutsideAsync = errors.New("coroutine yielded outside of an async function")
+
+// Registry fields of the function wrapping the starters of async functions, and
+// of the marker it yields.
+const (
+	cAsyncWrapper = "luar.async"
+	cAsyncMarker  = "luar.asyncmarker"
+)
+
+// The wrapper yields the marker, the starter and the arguments, for the event
+// loop to start the Go call. The loop resumes it with 'true, results...' or
+// with 'false, error' when the error must be raised. Starting the call once the
+// coroutine is suspended ensures that no call is left pending when the yield
+// fails.
+const cAsyncWrapperCode = `
+local yield, running, error = coroutine.yield, coroutine.running, error
+local marker = {}
+
+local function finish(ok, ...)
+	if not ok then
+		error(..., 0)
+	end
+	return ...
+end
+
+return function(start)
+	return function(...)
+		local co, main = running()
+		if not co or main then
+			error("async function called outside of the event loop", 2)
+		end
+		return finish(yield(marker, start, ...))
+	end
+end, marker
+`
+
+// EventLoop runs coroutines calling async Go functions.
+//
+// An async Go function called from a coroutine spawned by the loop suspends the
+// coroutine and runs in a new goroutine. When it returns, Run resumes the
+// coroutine with its results. Scripts can thus call Go services sequentially
+// without blocking other coroutines:
+//
+//	loop := luar.NewEventLoop(L)
+//	luar.Register(L, "", luar.Map{"fetch": loop.Async(fetch)})
+//	loop.Spawn(luar.NewLuaObjectFromName(L, "main"))
+//	err := loop.Run()
+//
+// An EventLoop must be used from the goroutine running the Lua state only.
+type EventLoop struct {
+	l       *lua.State
+	current *Coroutine
+	pending int
+
+	// The goroutines of async calls queue their results in 'done' and signal
+	// 'ready', without waiting for Run: they end even if Run is not called.
+	mu    sync.Mutex
+	done  []asyncResult
+	ready chan struct{}
+}
+
+// asyncResult is queued by the goroutine of an async call when it returns.
+type asyncResult struct {
+	co   *Coroutine
+	push func(T *lua.State) int
+}
+
+// NewEventLoop creates an event loop for the state L.
+func NewEventLoop(L *lua.State) *EventLoop {
+	return &EventLoop{l: L, ready: make(chan struct{}, 1)}
+}
+
+// Async returns a Lua function calling the Go function 'f' asynchronously. 'f'
+// may have an error policy set with WithErrorPolicy; raised errors propagate in
+// the calling coroutine.
+//
+// The returned function can only be called from a coroutine spawned by the
+// loop. Its arguments are converted once the coroutine is suspended; conversion
+// errors are raised in the coroutine.
+//
+// Since Lua 5.1 cannot yield across a call from Go or C, the function cannot
+// be called through 'pcall', metamethods or other functions calling Lua back:
+// the call then fails with "attempt to yield across metamethod/C-call
+// boundary" before the Go function is called.
+//
+// It panics if 'f' is not a function.
+func (loop *EventLoop) Async(f interface{}) *LuaObject {
+	var policy *ErrorPolicy
+	if pf, ok := f.(policyFunc); ok {
+		f, policy = pf.f, &pf.policy
+	}
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("luar: Async requires a function, got %T", f))
+	}
+	t := v.Type()
+
+	start := func(L *lua.State) int {
+		co := loop.current
+		args := goFunctionArgs(L, t)
+		loop.pending++
+		go func() {
+			loop.finish(asyncResult{co: co, push: asyncCall(v, args, policy)})
+		}()
+		return 0
+	}
+
+	L := loop.l
+	pushAsyncWrapper(L)
+	L.PushGoFunction(start)
+	if err := L.Call(1, 1); err != nil {
+		panic(err)
+	}
+	defer L.Pop(1)
+	return NewLuaObject(L, -1)
+}
+
+// Run resumes the coroutines as their async calls return, until no call is
+// pending.
+//
+// It returns the first error raised by a coroutine; that coroutine is dead
+// and Run can be called again to resume the others.
+func (loop *EventLoop) Run() error {
+	for loop.pending > 0 {
+		r, ok := loop.next()
+		if !ok {
+			<-loop.ready
+			continue
+		}
+		loop.pending--
+		if err := loop.resume(r.co, r.push); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish queues the result of an async call for Run.
+func (loop *EventLoop) finish(r asyncResult) {
+	loop.mu.Lock()
+	loop.done = append(loop.done, r)
+	loop.mu.Unlock()
+	select {
+	case loop.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next dequeues the result of an async call, if any.
+func (loop *EventLoop) next() (asyncResult, bool) {
+	loop.mu.Lock()
+	defer loop.mu.Unlock()
+	if len(loop.done) == 0 {
+		return asyncResult{}, false
+	}
+	r := loop.done[0]
+	loop.done[0] = asyncResult{}
+	loop.done = loop.done[1:]
+	return r, true
+}
+
+// Spawn creates a coroutine running the function 'lo' with 'args', and runs it
+// until it calls an async function or returns.
+func (loop *EventLoop) Spawn(lo *LuaObject, args ...interface{}) error {
+	co, err := NewCoroutine(lo)
+	if err != nil {
+		return err
+	}
+	return loop.resume(co, func(T *lua.State) int {
+		for _, arg := range args {
+			GoToLuaProxy(T, arg)
+		}
+		return len(args)
+	})
+}
+
+// resume resumes the coroutine 'co' with the arguments pushed by 'push' and
+// starts the async call it yields. The coroutine is closed when it ends.
+func (loop *EventLoop) resume(co *Coroutine, push func(T *lua.State) int) error {
+	loop.current = co
+	defer func() { loop.current = nil }()
+	for {
+		var next func(T *lua.State) int
+		err := co.resume(push, func(T *lua.State, n int) error {
+			if T.Status() != lua.LUA_YIELD {
+				return nil
+			}
+			if n < 2 || !isAsyncMarker(T, 1) {
+				return ErrYieldOutsideAsync
+			}
+			// Call the starter with the arguments.
+			L := loop.l
+			T.XMove(L, n-1)
+			if err := pcall(L, n-2, 0); err != nil {
+				msg := err.Error()
+				next = func(T *lua.State) int {
+					T.PushBoolean(false)
+					T.PushString(msg)
+					return 2
+				}
+			}
+			return nil
+		})
+		switch {
+		case err != nil:
+			co.Close()
+			return err
+		case co.Status() == CoroutineDead:
+			co.Close()
+			return nil
+		case next == nil:
+			return nil
+		}
+		push = next
+	}
+}
+
+// asyncCall calls the Go function 'v' and returns the function pushing the
+// values to resume the coroutine with.
+func asyncCall(v reflect.Value, args []reflect.Value, policy *ErrorPolicy) func(T *lua.State) int {
+	var results []reflect.Value
+	var err error
+	func() {
+		defer func() {
+			if x := recover(); x != nil {
+				if e, ok := x.(error); ok {
+					err = e
+				} else {
+					err = fmt.Errorf("error %s", x)
+				}
+			}
+		}()
+		results = v.Call(args)
+	}()
+
+	return func(T *lua.State) int {
+		if err == nil {
+			top := T.GetTop()
+			T.PushBoolean(true)
+			var n int
+			n, err = pushGoResults(T, v.Type(), results, policy, false)
+			if err == nil {
+				return 1 + n
+			}
+			T.SetTop(top)
+		}
+		T.PushBoolean(false)
+		makeValueProxy(T, reflect.ValueOf(err), cInterfaceMeta)
+		return 2
+	}
+}
+
+// isAsyncMarker reports whether the value at 'idx' is the marker yielded by async
+// functions.
+func isAsyncMarker(L *lua.State, idx int) bool {
+	L.GetField(lua.LUA_REGISTRYINDEX, cAsyncMarker)
+	defer L.Pop(1)
+	return L.RawEqual(idx, -1)
+}
+
+// pushAsyncWrapper pushes the function of 'cAsyncWrapperCode', creating it on
+// first use.
+func pushAsyncWrapper(L *lua.State) {
+	L.GetField(lua.LUA_REGISTRYINDEX, cAsyncWrapper)
+	if !L.IsNil(-1) {
+		return
+	}
+	L.Pop(1)
+	if L.LoadString(cAsyncWrapperCode) != 0 {
+		panic(L.ToString(-1))
+	}
+	if err := L.Call(0, 2); err != nil {
+		panic(err)
+	}
+	L.SetField(lua.LUA_REGISTRYINDEX, cAsyncMarker)
+	L.PushValue(-1)
+	L.SetField(lua.LUA_REGISTRYINDEX, cAsyncWrapper)
+}
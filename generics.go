@@ -0,0 +1,114 @@
+//go:build go1.23
+
+package luar
+
+// Typed helpers over LuaObject.
+
+import (
+	"iter"
+	"reflect"
+)
+
+// Call calls the Lua function 'fn' with 'args' and returns its first result
+// converted to R, as Get does:
+//
+//	port, err := luar.Call[int](fn, "server")
+//
+// See CallMulti to receive several results.
+func Call[R any](fn *LuaObject, args ...interface{}) (R, error) {
+	var r R
+	p := &r
+	err := fn.Call(&p, args...)
+	return r, err
+}
+
+// CallMulti is like Call but spreads the results over R as LuaObject.Call does:
+// a struct receives the first results in its exported fields and a slice
+// receives all the results. Other types return ErrLuaObjectCallResults:
+//
+//	qr, err := luar.CallMulti[struct{ Q, R int }](divmod, 7, 2)
+func CallMulti[R any](fn *LuaObject, args ...interface{}) (R, error) {
+	var r R
+	switch reflect.TypeOf(&r).Elem().Kind() {
+	case reflect.Slice, reflect.Struct:
+		err := fn.Call(&r, args...)
+		return r, err
+	}
+	return r, ErrLuaObjectCallResults
+}
+
+// Get returns the value indexed at the sequence of 'subfields' of 'lo',
+// converted to T as by LuaObject.Get:
+//
+//	port, err := luar.Get[int](config, "server", "port")
+func Get[T any](lo *LuaObject, subfields ...interface{}) (T, error) {
+	var v T
+	err := lo.Get(&v, subfields...)
+	return v, err
+}
+
+// Table is a typed view of an indexable LuaObject with keys of type K and
+// values of type V.
+type Table[K, V any] struct {
+	lo  *LuaObject
+	err error
+}
+
+// NewTable returns a typed view of 'lo'. Closing 'lo' is left to the caller.
+func NewTable[K, V any](lo *LuaObject) *Table[K, V] {
+	return &Table[K, V]{lo: lo}
+}
+
+// All returns an iterator over the key/value pairs of the table, as
+// LuaObject.Iter. The iteration stops at the first error, which is returned by
+// Err.
+func (t *Table[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		t.err = nil
+		ti, err := t.lo.Iter()
+		if err != nil {
+			t.err = err
+			return
+		}
+		defer ti.close()
+		for {
+			var key K
+			var value V
+			if !ti.Next(&key, &value) {
+				t.err = ti.Error()
+				return
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error which stopped the last iteration of All, if any.
+func (t *Table[K, V]) Err() error {
+	return t.err
+}
+
+// Get returns the value at 'key'.
+func (t *Table[K, V]) Get(key K) (V, error) {
+	return Get[V](t.lo, key)
+}
+
+// Len returns the length of the table, as LuaObject.Len.
+func (t *Table[K, V]) Len() (int, error) {
+	return t.lo.Len()
+}
+
+// Object returns the LuaObject of the table.
+func (t *Table[K, V]) Object() *LuaObject {
+	return t.lo
+}
+
+// Set sets the value at 'key'.
+func (t *Table[K, V]) Set(key K, value V) error {
+	L := t.lo.l
+	t.lo.Push()
+	defer L.Pop(1)
+	return set(L, key, value)
+}
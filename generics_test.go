@@ -0,0 +1,95 @@
+//go:build go1.23
+
+package luar
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerics(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	const code = `
+config = {server = {port = 8080}, ports = {80, 443}}
+function divmod(a, b) return math.floor(a / b), a % b end
+function point(x, y) return {X = x, Y = y}, "extra" end
+`
+	mustDoString(t, L, code)
+	config := NewLuaObjectFromName(L, "config")
+	defer config.Close()
+	divmod := NewLuaObjectFromName(L, "divmod")
+	defer divmod.Close()
+
+	port, err := Get[int](config, "server", "port")
+	if err != nil || port != 8080 {
+		t.Errorf("got %v, %v, want 8080", port, err)
+	}
+	if _, err := Get[string](config, "server"); err == nil {
+		t.Error("Get of a table as a string should fail")
+	}
+
+	q, err := Call[int](divmod, 7, 2)
+	if err != nil || q != 3 {
+		t.Errorf("got %v, %v, want 3", q, err)
+	}
+	point := NewLuaObjectFromName(L, "point")
+	defer point.Close()
+	type xy struct{ X, Y int }
+	pt, err := Call[xy](point, 1, 2)
+	if err != nil || pt != (xy{1, 2}) {
+		t.Errorf("got %v, %v, want {1 2}", pt, err)
+	}
+
+	type result struct{ Q, R int }
+	r, err := CallMulti[result](divmod, 7, 2)
+	if err != nil || r != (result{3, 1}) {
+		t.Errorf("got %v, %v, want {3 1}", r, err)
+	}
+	all, err := CallMulti[[]float64](divmod, 7, 2)
+	if err != nil || !reflect.DeepEqual(all, []float64{3, 1}) {
+		t.Errorf("got %v, %v, want [3 1]", all, err)
+	}
+	if _, err := CallMulti[int](divmod, 7, 2); err != ErrLuaObjectCallResults {
+		t.Errorf("got %v, want %v", err, ErrLuaObjectCallResults)
+	}
+
+	obj, _ := config.GetObject("ports")
+	defer obj.Close()
+	ports := NewTable[int, int](obj)
+	SetLeakTracking(L, true)
+	if err := ports.Set(3, 8443); err != nil {
+		t.Fatal(err)
+	}
+	if open := OpenLuaObjects(L); len(open) != 0 {
+		t.Errorf("got open objects %v, want none", open)
+	}
+	SetLeakTracking(L, false)
+	defer ForgetObjects(L)
+	if n, err := ports.Len(); err != nil || n != 3 {
+		t.Errorf("got length %v, %v, want 3", n, err)
+	}
+	if p, err := ports.Get(2); err != nil || p != 443 {
+		t.Errorf("got %v, %v, want 443", p, err)
+	}
+	sum := 0
+	for k, v := range ports.All() {
+		sum += k * v
+	}
+	if sum != 80+2*443+3*8443 || ports.Err() != nil {
+		t.Errorf("got sum %v, %v", sum, ports.Err())
+	}
+	for range ports.All() {
+		break
+	}
+	checkStack(t, L)
+
+	names := NewTable[int, string](obj)
+	for range names.All() {
+	}
+	if names.Err() == nil {
+		t.Error("iterating numbers as strings should fail")
+	}
+	checkStack(t, L)
+}
@@ -0,0 +1,131 @@
+//go:build go1.23
+
+package luar
+
+// Range-over-func iterators over LuaObject.
+
+import (
+	"iter"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// All returns an iterator over the key/value pairs of the indexable object, as
+// Iter, with keys and values converted as by LuaToGo to interface{}, and a
+// function returning the error which stopped the last iteration, if any:
+//
+//	pairs, errf := lo.All()
+//	for k, v := range pairs {
+//		fmt.Println(k, v)
+//	}
+//	if err := errf(); err != nil {
+//		// ...
+//	}
+//
+// The references held by the iteration are released when it ends, including on
+// 'break'.
+func (lo *LuaObject) All() (iter.Seq2[interface{}, interface{}], func() error) {
+	var err error
+	seq := func(yield func(interface{}, interface{}) bool) {
+		var ti *LuaTableIter
+		ti, err = lo.Iter()
+		if err != nil {
+			return
+		}
+		defer ti.close()
+		for {
+			var key, value interface{}
+			if !ti.Next(&key, &value) {
+				err = ti.Error()
+				return
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
+
+// IPairs returns an iterator over the array part of the object, like Lua's
+// 'ipairs': it yields the pairs (1, t[1]), (2, t[2]), ... up to the first nil
+// value. The '__ipairs' metamethod is honored, e.g. for proxies.
+//
+// Errors are reported as for All.
+func (lo *LuaObject) IPairs() (iter.Seq2[int, interface{}], func() error) {
+	var err error
+	seq := func(yield func(int, interface{}) bool) {
+		err = nil
+		L := lo.l
+		lo.Push()
+		if L.GetMetaField(-1, "__ipairs") {
+			L.Insert(-2)
+			err = ipairsMeta(L, yield)
+			return
+		}
+		isTable := L.IsTable(-1)
+		L.Pop(1)
+		if !isTable {
+			err = ErrLuaObjectIndexable
+			return
+		}
+		for i := 1; ; i++ {
+			lo.Push()
+			L.RawGeti(-1, i)
+			if L.IsNil(-1) {
+				L.Pop(2)
+				return
+			}
+			var value interface{}
+			err = LuaToGo(L, -1, &value)
+			L.Pop(2)
+			if err != nil {
+				return
+			}
+			if !yield(i, value) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
+
+// ipairsMeta iterates with the '__ipairs' metamethod and the object on top of
+// the stack, which are popped.
+func ipairsMeta(L *lua.State, yield func(int, interface{}) bool) error {
+	if err := pcall(L, 1, 3); err != nil {
+		return err
+	}
+	// The iterator and its state are kept in the registry while the loop body
+	// runs.
+	L.Pop(1)
+	stateRef := L.Ref(lua.LUA_REGISTRYINDEX)
+	defer L.Unref(lua.LUA_REGISTRYINDEX, stateRef)
+	iterRef := L.Ref(lua.LUA_REGISTRYINDEX)
+	defer L.Unref(lua.LUA_REGISTRYINDEX, iterRef)
+
+	for i := 0; ; {
+		L.RawGeti(lua.LUA_REGISTRYINDEX, iterRef)
+		L.RawGeti(lua.LUA_REGISTRYINDEX, stateRef)
+		L.PushInteger(int64(i))
+		if err := pcall(L, 2, 2); err != nil {
+			return err
+		}
+		if L.IsNil(-2) {
+			L.Pop(2)
+			return nil
+		}
+		var value interface{}
+		err := LuaToGo(L, -2, &i)
+		if err == nil {
+			err = LuaToGo(L, -1, &value)
+		}
+		L.Pop(2)
+		if err != nil {
+			return err
+		}
+		if !yield(i, value) {
+			return nil
+		}
+	}
+}
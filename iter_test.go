@@ -0,0 +1,89 @@
+//go:build go1.23
+
+package luar
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLuaObjectAll(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	mustDoString(t, L, `t = {10, 20, 30, name = "x"}; n = {1, 2, nil, 4}`)
+	tbl := NewLuaObjectFromName(L, "t")
+	defer tbl.Close()
+
+	got := map[interface{}]interface{}{}
+	pairs, errf := tbl.All()
+	for k, v := range pairs {
+		got[k] = v
+	}
+	want := map[interface{}]interface{}{1.0: 10.0, 2.0: 20.0, 3.0: 30.0, "name": "x"}
+	if !reflect.DeepEqual(got, want) || errf() != nil {
+		t.Errorf("got %v, %v, want %v", got, errf(), want)
+	}
+	for range pairs {
+		break
+	}
+	checkStack(t, L)
+
+	var values []interface{}
+	ipairs, errf := tbl.IPairs()
+	for i, v := range ipairs {
+		if i != len(values)+1 {
+			t.Errorf("got index %v, want %v", i, len(values)+1)
+		}
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, []interface{}{10.0, 20.0, 30.0}) || errf() != nil {
+		t.Errorf("got %v, %v, want [10 20 30]", values, errf())
+	}
+
+	n := NewLuaObjectFromName(L, "n")
+	defer n.Close()
+	count := 0
+	ipairs, _ = n.IPairs()
+	for range ipairs {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("got %v values, want 2", count)
+	}
+
+	GoToLuaProxy(L, []string{"a", "b", "c"})
+	proxy := NewLuaObject(L, -1)
+	L.Pop(1)
+	defer proxy.Close()
+	values = nil
+	ipairs, errf = proxy.IPairs()
+	for _, v := range ipairs {
+		values = append(values, v)
+		if len(values) == 2 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(values, []interface{}{"a", "b"}) || errf() != nil {
+		t.Errorf("got %v, %v, want [a b]", values, errf())
+	}
+	checkStack(t, L)
+
+	// Errors are kept per iterator, even when the loops are nested.
+	str := NewLuaObjectFromValue(L, "x")
+	defer str.Close()
+	L.Pop(1)
+	outer, outerErr := tbl.All()
+	for range outer {
+		inner, innerErr := str.All()
+		for range inner {
+		}
+		if innerErr() == nil {
+			t.Error("iterating a string should fail")
+		}
+	}
+	if err := outerErr(); err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+	checkStack(t, L)
+}
@@ -0,0 +1,237 @@
+package luar
+
+// Structured Lua errors.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// Registry field of the function calling functions in protected mode with the
+// message handler of 'cTrampolineCode'.
+const cTrampoline = "luar.xpcall"
+
+// The message handler records the location of the error and the traceback.
+// Level 1 is the handler itself, level 2 the function raising the error, which
+// may be a C function such as 'error'.
+//
+// golua's OpenLibs renames Lua's 'xpcall' to 'unsafe_xpcall'.
+const cTrampolineCode = `
+local xpcall = xpcall or unsafe_xpcall
+if not xpcall then
+	error("xpcall is not available", 0)
+end
+local select, tostring, unpack = select, tostring, unpack or table.unpack
+local getinfo = debug and debug.getinfo
+local traceback = debug and debug.traceback
+
+local function handler(msg)
+	local err = {msg = msg}
+	if getinfo then
+		for level = 2, 10 do
+			local info = getinfo(level, "Sl")
+			if not info then
+				break
+			end
+			if info.currentline > 0 then
+				err.chunk, err.line = info.short_src, info.currentline
+				break
+			end
+		end
+	end
+	if traceback then
+		err.traceback = traceback(tostring(msg), 2)
+	end
+	return err
+end
+
+return function(f, ...)
+	local n = select("#", ...)
+	local args = {...}
+	return xpcall(function() return f(unpack(args, 1, n)) end, handler)
+end
+`
+
+// LuaError is the error returned when the execution of Lua code fails.
+type LuaError struct {
+	// Message is the error message as raised in Lua. Runtime errors are
+	// prefixed with the location of the error.
+	Message string
+	// Chunk and Line locate the error. Chunk is empty when unknown.
+	Chunk string
+	Line  int
+	// Traceback is the Lua traceback at the point of the error.
+	Traceback string
+	// Err is the Go error that caused the Lua error, if any, e.g. when a Go
+	// function raised the error.
+	Err error
+}
+
+func (e *LuaError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the Go error that caused the Lua error, if any.
+func (e *LuaError) Unwrap() error {
+	return e.Err
+}
+
+// setStack sets the location and the traceback of the error from 'stack'.
+func (e *LuaError) setStack(stack []lua.LuaStackEntry) {
+	var traceback []string
+	for _, entry := range stack {
+		if e.Chunk == "" && entry.CurrentLine > 0 {
+			e.Chunk, e.Line = entry.ShortSource, entry.CurrentLine
+		}
+		line := "\t" + entry.ShortSource + ":"
+		if entry.CurrentLine > 0 {
+			line += fmt.Sprintf("%d:", entry.CurrentLine)
+		}
+		if entry.Name != "" {
+			line += " in function '" + entry.Name + "'"
+		}
+		traceback = append(traceback, line)
+	}
+	if len(traceback) > 0 {
+		e.Traceback = e.Message + "\nstack traceback:\n" + strings.Join(traceback, "\n")
+	}
+}
+
+// errorOfProxy returns the Go error of the error proxy at 'idx', or nil if it is
+// not an error proxy.
+func errorOfProxy(L *lua.State, idx int) error {
+	if !isValueProxy(L, idx) {
+		return nil
+	}
+	v, _ := valueOfProxy(L, idx)
+	if !v.CanInterface() {
+		return nil
+	}
+	err, _ := v.Interface().(error)
+	return err
+}
+
+// goError is raised when a Go function called from Lua panics with an error.
+// It keeps the original error across Lua calls.
+type goError struct {
+	err   error
+	msg   string
+	stack []lua.LuaStackEntry
+}
+
+func (e *goError) Error() string {
+	return e.msg
+}
+
+func (e *goError) Unwrap() error {
+	return e.err
+}
+
+// luaErrorMessage returns the message of the Lua error value at 'idx'.
+func luaErrorMessage(L *lua.State, idx int) string {
+	if L.IsString(idx) {
+		return L.ToString(idx)
+	}
+	if err := errorOfProxy(L, idx); err != nil {
+		return err.Error()
+	}
+	return luaDesc(L, idx)
+}
+
+// newGoLuaError converts an error returned by golua, e.g. when a Go function
+// called from Lua raised an error.
+func newGoLuaError(err error) *LuaError {
+	e := &LuaError{Message: err.Error(), Err: err}
+	var stack []lua.LuaStackEntry
+	switch gerr := err.(type) {
+	case *goError:
+		e.Err = gerr.err
+		stack = gerr.stack
+	case *lua.LuaError:
+		stack = gerr.StackTrace()
+	default:
+		return e
+	}
+	e.setStack(stack)
+	return e
+}
+
+// pcall is like L.Call but errors are returned as *LuaError. On success,
+// 'nresults' results are left on the stack, or all of them if 'nresults' is
+// lua.LUA_MULTRET. On error, the function and its arguments are popped.
+func pcall(L *lua.State, nargs, nresults int) error {
+	base := L.GetTop() - nargs
+	if err := pushTrampoline(L); err != nil {
+		L.SetTop(base - 1)
+		return err
+	}
+	L.Insert(base)
+	err := L.Call(nargs+1, lua.LUA_MULTRET)
+	if err != nil {
+		L.SetTop(base - 1)
+		return newGoLuaError(err)
+	}
+
+	if !L.ToBoolean(base) {
+		e := &LuaError{}
+		if L.IsTable(base + 1) {
+			L.GetField(base+1, "msg")
+			e.Message = luaErrorMessage(L, -1)
+			e.Err = errorOfProxy(L, -1)
+			L.GetField(base+1, "chunk")
+			e.Chunk = L.ToString(-1)
+			L.GetField(base+1, "line")
+			e.Line = L.ToInteger(-1)
+			L.GetField(base+1, "traceback")
+			e.Traceback = L.ToString(-1)
+		} else {
+			// The handler failed, e.g. on memory errors.
+			e.Message = luaErrorMessage(L, base+1)
+		}
+		L.SetTop(base - 1)
+		return e
+	}
+
+	L.Remove(base)
+	if nresults != lua.LUA_MULTRET {
+		L.SetTop(base - 1 + nresults)
+	}
+	return nil
+}
+
+// pushTrampoline pushes the function of 'cTrampolineCode', creating it on
+// first use. Nothing is pushed on error.
+func pushTrampoline(L *lua.State) error {
+	L.GetField(lua.LUA_REGISTRYINDEX, cTrampoline)
+	if !L.IsNil(-1) {
+		return nil
+	}
+	L.Pop(1)
+	if L.LoadString(cTrampolineCode) != 0 {
+		msg := L.ToString(-1)
+		L.Pop(1)
+		return &LuaError{Message: msg}
+	}
+	if err := L.Call(0, 1); err != nil {
+		return newGoLuaError(err)
+	}
+	L.PushValue(-1)
+	L.SetField(lua.LUA_REGISTRYINDEX, cTrampoline)
+	return nil
+}
+
+// raiseGoError raises 'err' as a Lua error, prefixed with the location of the
+// Lua caller like L.RaiseError does.
+func raiseGoError(L *lua.State, err error) {
+	stack := L.StackTrace()
+	msg := err.Error()
+	for _, entry := range stack {
+		if entry.CurrentLine > 0 {
+			msg = fmt.Sprintf("%s:%d: %s", entry.ShortSource, entry.CurrentLine, msg)
+			break
+		}
+	}
+	panic(&goError{err: err, msg: msg, stack: stack})
+}
@@ -2,7 +2,10 @@ package luar
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"reflect"
+	"runtime"
 
 	"github.com/aarzilli/golua/lua"
 )
@@ -14,20 +17,35 @@ import (
 type LuaObject struct {
 	l   *lua.State
 	ref int
+	// tracker releases the reference when the object is garbage-collected, if
+	// not nil.
+	tracker *objectTracker
 }
 
 var (
 	ErrLuaObjectCallResults   = errors.New("results must be a pointer to pointer/slice/struct")
 	ErrLuaObjectCallable      = errors.New("LuaObject must be callable")
 	ErrLuaObjectIndexable     = errors.New("not indexable")
+	ErrLuaObjectLength        = errors.New("no length")
 	ErrLuaObjectUnsharedState = errors.New("LuaObjects must share the same state")
 )
 
+// Registry field of the function comparing its arguments with '==', called in
+// protected mode since '__eq' may raise errors.
+const cEqual = "luar.equal"
+
+const cEqualCode = `local a, b = ...
+return a == b`
+
 // NewLuaObject creates a new LuaObject from stack index.
 func NewLuaObject(L *lua.State, idx int) *LuaObject {
 	L.PushValue(idx)
 	ref := L.Ref(lua.LUA_REGISTRYINDEX)
-	return &LuaObject{l: L, ref: ref}
+	lo := &LuaObject{l: L, ref: ref}
+	if lo.tracker = trackRef(L, ref); lo.tracker != nil {
+		runtime.SetFinalizer(lo, func(lo *LuaObject) { lo.tracker.finalize(lo.ref) })
+	}
+	return lo
 }
 
 // NewLuaObjectFromName creates a new LuaObject from the object designated by
@@ -64,6 +82,8 @@ func NewLuaObjectFromValue(L *lua.State, val interface{}) *LuaObject {
 // argument, they will be ignored.
 //
 // If 'results' is nil, results will be discarded.
+//
+// Errors raised during the call are returned as *LuaError.
 func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 	L := lo.l
 	// Push the callable value.
@@ -82,16 +102,54 @@ func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 		GoToLuaProxy(L, arg)
 	}
 
-	// Special case: discard the results.
+	nresults, err := resultCount(results)
+	if err != nil {
+		L.Pop(1 + len(args))
+		return err
+	}
+	residx := L.GetTop() - len(args)
+	if err := pcall(L, len(args), nresults); err != nil {
+		return err
+	}
+	nresults = L.GetTop() - residx + 1
+	defer L.Pop(nresults)
+	return storeResults(L, residx, nresults, results)
+}
+
+// resultCount returns the number of results to request from a call storing its
+// results in 'results', as described in Call.
+func resultCount(results interface{}) (int, error) {
 	if results == nil {
-		err := L.Call(len(args), 0)
-		if err != nil {
-			L.Pop(1)
-			return err
+		return 0, nil
+	}
+	resptr := reflect.ValueOf(results)
+	if resptr.Kind() != reflect.Ptr {
+		return 0, ErrLuaObjectCallResults
+	}
+	res := resptr.Elem()
+	switch res.Kind() {
+	case reflect.Ptr:
+		return 1, nil
+	case reflect.Slice:
+		return lua.LUA_MULTRET, nil
+	case reflect.Struct:
+		n := 0
+		for i := 0; i < res.NumField(); i++ {
+			if res.Field(i).CanInterface() {
+				n++
+			}
 		}
-		return nil
+		return n, nil
 	}
+	return 0, ErrLuaObjectCallResults
+}
 
+// storeResults stores the 'nresults' values starting at 'residx' in 'results',
+// as described in Call. Missing values are stored as nil.
+func storeResults(L *lua.State, residx, nresults int, results interface{}) error {
+	if results == nil {
+		return nil
+	}
 	resptr := reflect.ValueOf(results)
 	if resptr.Kind() != reflect.Ptr {
 		return ErrLuaObjectCallResults
@@ -100,23 +158,14 @@ func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 
 	switch res.Kind() {
 	case reflect.Ptr:
-		err := L.Call(len(args), 1)
-		defer L.Pop(1)
-		if err != nil {
-			return err
+		if nresults == 0 {
+			L.PushNil()
+			defer L.Pop(1)
+			residx = L.GetTop()
 		}
-		return LuaToGo(L, -1, res.Interface())
+		return LuaToGo(L, residx, res.Interface())
 
 	case reflect.Slice:
-		residx := L.GetTop() - len(args)
-		err := L.Call(len(args), lua.LUA_MULTRET)
-		if err != nil {
-			L.Pop(1)
-			return err
-		}
-
-		nresults := L.GetTop() - residx + 1
-		defer L.Pop(nresults)
 		t := res.Type()
 
 		// Adjust the length of the slice.
@@ -128,7 +177,7 @@ func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 		}
 
 		for i := 0; i < nresults; i++ {
-			err = LuaToGo(L, residx+i, res.Index(i).Addr().Interface())
+			err := LuaToGo(L, residx+i, res.Index(i).Addr().Interface())
 			if err != nil {
 				return err
 			}
@@ -138,20 +187,16 @@ func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 		exportedFields := []reflect.Value{}
 		for i := 0; i < res.NumField(); i++ {
 			if res.Field(i).CanInterface() {
-				exportedFields = append(exportedFields, res.Field(i).Addr())
+				exportedFields = append(exportedFields, res.Field(i))
 			}
 		}
-		nresults := len(exportedFields)
-		err := L.Call(len(args), nresults)
-		if err != nil {
-			L.Pop(1)
-			return err
-		}
-		defer L.Pop(nresults)
-		residx := L.GetTop() - nresults + 1
 
-		for i := 0; i < nresults; i++ {
-			err = LuaToGo(L, residx+i, exportedFields[i].Interface())
+		for i, field := range exportedFields {
+			if i >= nresults {
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			err := LuaToGo(L, residx+i, field.Addr().Interface())
 			if err != nil {
 				return err
 			}
@@ -166,7 +211,15 @@ func (lo *LuaObject) Call(results interface{}, args ...interface{}) error {
 
 // Close frees the Lua reference of this object.
 func (lo *LuaObject) Close() {
+	if lo.ref == lua.LUA_NOREF {
+		return
+	}
 	lo.l.Unref(lua.LUA_REGISTRYINDEX, lo.ref)
+	if lo.tracker != nil {
+		runtime.SetFinalizer(lo, nil)
+	}
+	untrackRef(lo.l, lo.ref, lo.tracker)
+	lo.ref, lo.tracker = lua.LUA_NOREF, nil
 }
 
 // get pushes the Lua value indexed at the sequence of 'subfields' from the
@@ -232,6 +285,7 @@ func (lo *LuaObject) GetObject(subfields ...interface{}) (*LuaObject, error) {
 
 // Push pushes this LuaObject on the stack.
 func (lo *LuaObject) Push() {
+	releaseObjects(lo.l)
 	lo.l.RawGeti(lua.LUA_REGISTRYINDEX, lo.ref)
 }
 
@@ -248,15 +302,19 @@ func (lo *LuaObject) Set(a interface{}, subfields ...interface{}) error {
 	L := parent.l
 	parent.Push()
 	defer L.Pop(1)
+	return set(L, subfields[len(subfields)-1], a)
+}
 
-	lastField := subfields[len(subfields)-1]
+// set sets the value at 'key' of the value on top of the stack with the value
+// 'a'.
+func set(L *lua.State, key, a interface{}) error {
 	if L.IsTable(-1) {
-		GoToLuaProxy(L, lastField)
+		GoToLuaProxy(L, key)
 		GoToLuaProxy(L, a)
 		L.SetTable(-3)
 	} else if L.GetMetaField(-1, "__newindex") {
 		L.PushValue(-2)
-		GoToLuaProxy(L, lastField)
+		GoToLuaProxy(L, key)
 		GoToLuaProxy(L, a)
 		err := L.Call(3, 0)
 		if err != nil {
@@ -326,6 +384,174 @@ func (lo *LuaObject) Setv(src *LuaObject, keys ...string) error {
 	return nil
 }
 
+// Bool returns the boolean indexed at the sequence of 'subfields'. It returns
+// an error if the value is not a boolean.
+func (lo *LuaObject) Bool(subfields ...interface{}) (bool, error) {
+	var b bool
+	err := lo.getTyped(lua.LUA_TBOOLEAN, &b, subfields)
+	return b, err
+}
+
+// Equals reports whether this object and 'other' are equal as with Lua's '=='
+// operator, which calls the '__eq' metamethod. Errors raised by the metamethod
+// are returned as *LuaError.
+func (lo *LuaObject) Equals(other *LuaObject) (bool, error) {
+	L := lo.l
+	if L != other.l {
+		return false, ErrLuaObjectUnsharedState
+	}
+	if err := pushEqual(L); err != nil {
+		return false, err
+	}
+	lo.Push()
+	other.Push()
+	if err := pcall(L, 2, 1); err != nil {
+		return false, err
+	}
+	defer L.Pop(1)
+	return L.ToBoolean(-1), nil
+}
+
+// Float returns the number indexed at the sequence of 'subfields'. It returns
+// an error if the value is not a number.
+func (lo *LuaObject) Float(subfields ...interface{}) (float64, error) {
+	var f float64
+	err := lo.getTyped(lua.LUA_TNUMBER, &f, subfields)
+	return f, err
+}
+
+// GetString returns the string indexed at the sequence of 'subfields'. It
+// returns an error if the value is not a string.
+func (lo *LuaObject) GetString(subfields ...interface{}) (string, error) {
+	var s string
+	err := lo.getTyped(lua.LUA_TSTRING, &s, subfields)
+	return s, err
+}
+
+// Int returns the integer indexed at the sequence of 'subfields'. It returns an
+// error if the value is not a number, has a fractional part or overflows int.
+func (lo *LuaObject) Int(subfields ...interface{}) (int, error) {
+	f, err := lo.Float(subfields...)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) || f < math.MinInt || f >= -math.MinInt {
+		return 0, ConvError{From: fmt.Sprintf("Lua number '%v'", f), To: reflect.TypeOf(0)}
+	}
+	return int(f), nil
+}
+
+// IsNil reports whether the object is nil.
+func (lo *LuaObject) IsNil() bool {
+	lo.Push()
+	defer lo.l.Pop(1)
+	return lo.l.IsNil(-1)
+}
+
+// Keys returns the keys of the indexable object, in no particular order. The
+// '__pairs' metamethod is honored as in Iter.
+func (lo *LuaObject) Keys() ([]interface{}, error) {
+	iter, err := lo.Iter()
+	if err != nil {
+		return nil, err
+	}
+	var keys []interface{}
+	var key interface{}
+	for iter.Next(&key, nil) {
+		keys = append(keys, key)
+	}
+	return keys, iter.Error()
+}
+
+// Len returns the length of the object as with Lua's '#' operator: the length
+// of strings and tables, or the result of the '__len' metamethod.
+func (lo *LuaObject) Len() (int, error) {
+	L := lo.l
+	lo.Push()
+	defer L.Pop(1)
+	switch L.Type(-1) {
+	case lua.LUA_TSTRING, lua.LUA_TTABLE:
+		return int(L.ObjLen(-1)), nil
+	}
+	if !L.GetMetaField(-1, "__len") {
+		return 0, ErrLuaObjectLength
+	}
+	L.PushValue(-2)
+	if err := pcall(L, 1, 1); err != nil {
+		return 0, err
+	}
+	defer L.Pop(1)
+	if !L.IsNumber(-1) {
+		return 0, ConvError{From: luaDesc(L, -1), To: reflect.TypeOf(0)}
+	}
+	return L.ToInteger(-1), nil
+}
+
+// RawEquals reports whether this object and 'other' are primitively equal, as
+// with Lua's 'rawequal' function.
+func (lo *LuaObject) RawEquals(other *LuaObject) (bool, error) {
+	L := lo.l
+	if L != other.l {
+		return false, ErrLuaObjectUnsharedState
+	}
+	lo.Push()
+	other.Push()
+	defer L.Pop(2)
+	return L.RawEqual(-2, -1), nil
+}
+
+// String implements fmt.Stringer: it returns the object as converted by Lua's
+// 'tostring', or the error raised by the conversion.
+func (lo *LuaObject) String() string {
+	L := lo.l
+	L.GetGlobal("tostring")
+	lo.Push()
+	if err := pcall(L, 1, 1); err != nil {
+		return err.Error()
+	}
+	defer L.Pop(1)
+	return L.ToString(-1)
+}
+
+// Type returns the Lua type of the object.
+func (lo *LuaObject) Type() lua.LuaValType {
+	lo.Push()
+	defer lo.l.Pop(1)
+	return lo.l.Type(-1)
+}
+
+// getTyped stores in 'a' the Lua value indexed at the sequence of 'subfields' if
+// it has the Lua type 't'.
+func (lo *LuaObject) getTyped(t lua.LuaValType, a interface{}, subfields []interface{}) error {
+	L := lo.l
+	lo.Push()
+	defer L.Pop(1)
+	err := get(L, subfields...)
+	if err != nil {
+		return err
+	}
+	defer L.Pop(1)
+	if L.Type(-1) != t {
+		return ConvError{From: luaDesc(L, -1), To: reflect.TypeOf(a).Elem()}
+	}
+	return LuaToGo(L, -1, a)
+}
+
+// pushEqual pushes the function of 'cEqualCode', creating it on first use.
+func pushEqual(L *lua.State) error {
+	L.GetField(lua.LUA_REGISTRYINDEX, cEqual)
+	if !L.IsNil(-1) {
+		return nil
+	}
+	L.Pop(1)
+	if L.LoadString(cEqualCode) != 0 {
+		return loadError(L)
+	}
+	L.PushValue(-1)
+	L.SetField(lua.LUA_REGISTRYINDEX, cEqual)
+	return nil
+}
+
 // LuaTableIter is the Go equivalent of a Lua table iterator.
 type LuaTableIter struct {
 	lo *LuaObject
@@ -336,6 +562,21 @@ type LuaTableIter struct {
 	iterRef int
 	// TODO: See if this is an idiomatic implementation of error storage.
 	err error
+	// done is set when the references have been released.
+	done bool
+}
+
+// close releases the references held by the iterator, which ends the
+// iteration.
+func (ti *LuaTableIter) close() {
+	if ti.done || ti.lo == nil {
+		return
+	}
+	L := ti.lo.l
+	L.Unref(lua.LUA_REGISTRYINDEX, ti.keyRef)
+	L.Unref(lua.LUA_REGISTRYINDEX, ti.iterRef)
+	ti.keyRef, ti.iterRef = lua.LUA_NOREF, lua.LUA_NOREF
+	ti.done = true
 }
 
 // Error returns the error that happened during last iteration, if any.
@@ -376,6 +617,9 @@ func (ti *LuaTableIter) Next(key, value interface{}) bool {
 		ti.err = errors.New("empty iterator")
 		return false
 	}
+	if ti.done {
+		return false
+	}
 	L := ti.lo.l
 
 	if ti.iterRef == lua.LUA_NOREF {
@@ -393,7 +637,7 @@ func (ti *LuaTableIter) Next(key, value interface{}) bool {
 		}
 
 		if L.Next(-2) == 0 {
-			L.Unref(lua.LUA_REGISTRYINDEX, ti.keyRef)
+			ti.close()
 			return false
 		}
 
@@ -415,23 +659,21 @@ func (ti *LuaTableIter) Next(key, value interface{}) bool {
 		}
 		if L.IsNil(-2) {
 			L.Pop(2)
-			L.Unref(lua.LUA_REGISTRYINDEX, ti.iterRef)
+			ti.close()
 			return false
 		}
 	}
 
 	err := LuaToGo(L, -2, key)
+	if err == nil && value != nil {
+		err = LuaToGo(L, -1, value)
+	}
 	if err != nil {
+		L.Pop(2)
+		ti.close()
 		ti.err = err
 		return false
 	}
-	if value != nil {
-		err = LuaToGo(L, -1, value)
-		if err != nil {
-			ti.err = err
-			return false
-		}
-	}
 
 	// Drop value, key is now on top.
 	L.Pop(1)
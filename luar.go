@@ -76,6 +76,11 @@ var (
 type visitor struct {
 	L     *lua.State
 	index int
+	// readOnly is set when the pushed proxies must be read-only.
+	readOnly bool
+	// writeBack is set when the pushed proxies refer to a copy that must be
+	// stored back into its parent after modifications. See valueProxy.
+	writeBack func()
 }
 
 func newVisitor(L *lua.State) visitor {
@@ -108,6 +113,11 @@ func (v *visitor) mark(val reflect.Value) {
 	v.L.Pop(1)
 }
 
+// Push a proxy of 'val' with the options of the conversion.
+func (v *visitor) proxy(val reflect.Value, proxyMT string) {
+	makeProxy(v.L, &valueProxy{v: val, t: val.Type(), readOnly: v.readOnly, writeBack: v.writeBack}, proxyMT)
+}
+
 // Push visited value on top of the stack.
 // If the value was not visited, return false and push nothing.
 func (v *visitor) push(val reflect.Value) bool {
@@ -128,6 +138,7 @@ func (v *visitor) push(val reflect.Value) bool {
 // It populates the 'luar' table with some helper functions/values:
 //
 //   method: ProxyMethod
+//   fields: ProxyFields
 //   unproxify: Unproxify
 //
 //   chan: MakeChan
@@ -135,13 +146,20 @@ func (v *visitor) push(val reflect.Value) bool {
 //   map: MakeMap
 //   slice: MakeSlice
 //
+//   ref: MakeRef
+//   select: ChanSelect
+//
 //   null: Null
 //
+//   band, bor, bxor, bnot, shl, shr, idiv: Go integer operations on numbers
+//   and number proxies, for Lua versions without the Lua 5.3 operators.
+//
 // It replaces the 'pairs'/'ipairs' functions with ProxyPairs/ProxyIpairs
 // respectively, so that __pairs/__ipairs can be used, Lua 5.2 style. It allows
 // for looping over Go composite types and strings.
 //
-// It also replaces the 'type' function with ProxyType.
+// It also replaces the 'type' function with ProxyType and the 'pcall' function
+// with ProxyPcall.
 //
 // It is not required for using the 'GoToLua' and 'LuaToGo' functions.
 func Init() *lua.State {
@@ -152,17 +170,30 @@ func Init() *lua.State {
 		"unproxify": Unproxify,
 
 		"method": ProxyMethod,
+		"fields": ProxyFields,
 
 		"chan":    MakeChan,
 		"complex": Complex,
 		"map":     MakeMap,
 		"slice":   MakeSlice,
 
+		"ref":    MakeRef,
+		"select": ChanSelect,
+
+		"band": number__band,
+		"bor":  number__bor,
+		"bxor": number__bxor,
+		"bnot": number__bnot,
+		"shl":  number__shl,
+		"shr":  number__shr,
+		"idiv": number__idiv,
+
 		// Values.
 		"null": Null,
 	})
 	Register(L, "", Map{
 		"pairs": ProxyPairs,
+		"pcall": ProxyPcall,
 		"type":  ProxyType,
 	})
 	// 'ipairs' needs a special case for performance reasons.
@@ -245,6 +276,9 @@ func copyStructToTable(L *lua.State, v reflect.Value, visited visitor) {
 	for i := 0; i < n; i++ {
 		st := v.Type()
 		field := st.Field(i)
+		if !isMemberAccessible(st, field.Name) {
+			continue
+		}
 		key := field.Name
 		tag := field.Tag.Get("lua")
 		if tag != "" {
@@ -260,6 +294,9 @@ func copyStructToTable(L *lua.State, v reflect.Value, visited visitor) {
 func callGoFunction(L *lua.State, v reflect.Value, args []reflect.Value) []reflect.Value {
 	defer func() {
 		if x := recover(); x != nil {
+			if err, ok := x.(error); ok {
+				raiseGoError(L, err)
+			}
 			L.RaiseError(fmt.Sprintf("error %s", x))
 		}
 	}()
@@ -267,56 +304,94 @@ func callGoFunction(L *lua.State, v reflect.Value, args []reflect.Value) []refle
 	return results
 }
 
-func goToLuaFunction(L *lua.State, v reflect.Value) lua.LuaGoFunction {
-	switch f := v.Interface().(type) {
-	case func(*lua.State) int:
-		return f
-	}
-
-	t := v.Type()
+// goFunctionArgs converts the arguments on the stack to the argument types of
+// the Go function type 't'.
+func goFunctionArgs(L *lua.State, t reflect.Type) []reflect.Value {
 	argsT := make([]reflect.Type, t.NumIn())
 	for i := range argsT {
 		argsT[i] = t.In(i)
 	}
 
-	return func(L *lua.State) int {
-		var lastT reflect.Type
-		isVariadic := t.IsVariadic()
+	var lastT reflect.Type
+	if t.IsVariadic() {
+		n := len(argsT)
+		lastT = argsT[n-1].Elem()
+		argsT = argsT[:n-1]
+	}
 
-		if isVariadic {
-			n := len(argsT)
-			lastT = argsT[n-1].Elem()
-			argsT = argsT[:n-1]
+	args := make([]reflect.Value, len(argsT))
+	for i, t := range argsT {
+		val := reflect.New(t)
+		err := LuaToGo(L, i+1, val.Interface())
+		if err != nil {
+			L.RaiseError(fmt.Sprintf("cannot convert Go function argument #%v: %v", i, err))
 		}
+		args[i] = val.Elem()
+	}
 
-		args := make([]reflect.Value, len(argsT))
-		for i, t := range argsT {
-			val := reflect.New(t)
-			err := LuaToGo(L, i+1, val.Interface())
+	if t.IsVariadic() {
+		n := L.GetTop()
+		for i := len(argsT) + 1; i <= n; i++ {
+			val := reflect.New(lastT)
+			err := LuaToGo(L, i, val.Interface())
 			if err != nil {
 				L.RaiseError(fmt.Sprintf("cannot convert Go function argument #%v: %v", i, err))
 			}
-			args[i] = val.Elem()
+			args = append(args, val.Elem())
 		}
+	}
+	return args
+}
+
+// goToLuaFunction wraps the Go function 'v'. 'policy' is its error policy, or
+// nil to use the global policy. If 'readOnly' is set, the results are pushed
+// as read-only proxies.
+func goToLuaFunction(L *lua.State, v reflect.Value, policy *ErrorPolicy, readOnly bool) lua.LuaGoFunction {
+	switch f := v.Interface().(type) {
+	case func(*lua.State) int:
+		return f
+	}
 
-		if isVariadic {
-			n := L.GetTop()
-			for i := len(argsT) + 1; i <= n; i++ {
-				val := reflect.New(lastT)
-				err := LuaToGo(L, i, val.Interface())
-				if err != nil {
-					L.RaiseError(fmt.Sprintf("cannot convert Go function argument #%v: %v", i, err))
+	t := v.Type()
+	return func(L *lua.State) int {
+		args := goFunctionArgs(L, t)
+		results := callGoFunction(L, v, args)
+		n, err := pushGoResults(L, t, results, policy, readOnly)
+		if err != nil {
+			raiseGoError(L, err)
+		}
+		return n
+	}
+}
+
+// pushGoResults pushes the results of a call to a Go function of type 't' and
+// returns their number. The error returned as last result is handled according
+// to 'policy': it is returned when it must be raised. If 'readOnly' is set, the
+// results are pushed as read-only proxies.
+func pushGoResults(L *lua.State, t reflect.Type, results []reflect.Value, policy *ErrorPolicy, readOnly bool) (int, error) {
+	if n := len(results); n > 0 && t.Out(n-1) == errorType {
+		if p := currentErrorPolicy(policy); p != ErrorPassThrough {
+			errv := results[n-1]
+			results = results[:n-1]
+			if !errv.IsNil() {
+				err := errv.Interface().(error)
+				if p == ErrorRaise {
+					return 0, err
 				}
-				args = append(args, val.Elem())
+				L.PushNil()
+				L.PushString(err.Error())
+				return 2, nil
 			}
-			argsT = argsT[:len(argsT)+1]
 		}
-		results := callGoFunction(L, v, args)
-		for _, val := range results {
+	}
+	for _, val := range results {
+		if readOnly {
+			GoToLuaReadOnly(L, val)
+		} else {
 			GoToLuaProxy(L, val)
 		}
-		return len(results)
 	}
+	return len(results), nil
 }
 
 // GoToLua pushes a Go value 'val' on the Lua stack.
@@ -371,6 +446,23 @@ func GoToLuaProxy(L *lua.State, a interface{}) {
 	visited.close()
 }
 
+// GoToLuaReadOnly is like GoToLuaProxy but the proxies cannot be used to
+// modify the Go value.
+//
+// Setting fields and elements, appending to slices, sending to or closing
+// channels and calling methods with a pointer receiver raise an error. Values
+// reached from a read-only proxy, such as fields and elements, are read-only
+// too.
+//
+// Note that Go functions receiving a read-only proxy as argument can still
+// modify the Go value.
+func GoToLuaReadOnly(L *lua.State, a interface{}) {
+	visited := newVisitor(L)
+	visited.readOnly = true
+	goToLua(L, a, true, visited)
+	visited.close()
+}
+
 func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 	var v reflect.Value
 	v, ok := a.(reflect.Value)
@@ -387,6 +479,12 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 		v = reflect.ValueOf(v.Interface())
 	}
 
+	if v.Type() == reflect.TypeOf(policyFunc{}) {
+		f := v.Interface().(policyFunc)
+		L.PushGoFunction(goToLuaFunction(L, reflect.ValueOf(f.f), &f.policy, visited.readOnly))
+		return
+	}
+
 	// Follow pointers if not proxifying. We save the parent pointer Value in case
 	// we proxify since Lua cannot dereference pointers and has no use of
 	// multiple-level references, while single references are useful for method
@@ -404,43 +502,50 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 
 	// As a special case, we always proxify Null, the empty element for slices and maps.
 	if v.CanInterface() && v.Interface() == Null {
-		makeValueProxy(L, v, cInterfaceMeta)
+		visited.proxy(v, cInterfaceMeta)
+		return
+	}
+
+	// Pointers to primitive values are proxified as references so that Lua can
+	// modify the value they point to.
+	if proxify && isPointerToPrimitive(vp) {
+		visited.proxy(vp, cRefMeta)
 		return
 	}
 
 	switch v.Kind() {
 	case reflect.Float64, reflect.Float32:
 		if proxify && isNewType(v.Type()) {
-			makeValueProxy(L, vp, cNumberMeta)
+			visited.proxy(vp, cNumberMeta)
 		} else {
 			L.PushNumber(v.Float())
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if proxify && isNewType(v.Type()) {
-			makeValueProxy(L, vp, cNumberMeta)
+			visited.proxy(vp, cNumberMeta)
 		} else {
 			L.PushNumber(float64(v.Int()))
 		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		if proxify && isNewType(v.Type()) {
-			makeValueProxy(L, vp, cNumberMeta)
+			visited.proxy(vp, cNumberMeta)
 		} else {
 			L.PushNumber(float64(v.Uint()))
 		}
 	case reflect.String:
 		if proxify && isNewType(v.Type()) {
-			makeValueProxy(L, vp, cStringMeta)
+			visited.proxy(vp, cStringMeta)
 		} else {
 			L.PushString(v.String())
 		}
 	case reflect.Bool:
 		if proxify && isNewType(v.Type()) {
-			makeValueProxy(L, vp, cInterfaceMeta)
+			visited.proxy(vp, cInterfaceMeta)
 		} else {
 			L.PushBoolean(v.Bool())
 		}
 	case reflect.Complex128, reflect.Complex64:
-		makeValueProxy(L, vp, cComplexMeta)
+		visited.proxy(vp, cComplexMeta)
 	case reflect.Array:
 		if proxify {
 			// To check if it is a user-defined type, we compare its type to that of a
@@ -453,7 +558,7 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 					// 'vp' is a pointer of v.Type(), we want the dereferenced type.
 					vp = vp.Elem()
 				}
-				makeValueProxy(L, vp, cSliceMeta)
+				visited.proxy(vp, cSliceMeta)
 				return
 			}
 			// Else don't proxify.
@@ -465,7 +570,7 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 		copySliceToTable(L, vp, visited)
 	case reflect.Slice:
 		if proxify {
-			makeValueProxy(L, vp, cSliceMeta)
+			visited.proxy(vp, cSliceMeta)
 		} else {
 			if visited.push(v) {
 				return
@@ -474,7 +579,7 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 		}
 	case reflect.Map:
 		if proxify {
-			makeValueProxy(L, vp, cMapMeta)
+			visited.proxy(vp, cMapMeta)
 		} else {
 			if visited.push(v) {
 				return
@@ -510,7 +615,7 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 				vp = reflect.New(v.Type())
 				vp.Elem().Set(v)
 			}
-			makeValueProxy(L, vp, cStructMeta)
+			visited.proxy(vp, cStructMeta)
 		} else {
 			// Use vp instead of v to detect cycles from the very first element, if a pointer.
 			if vp.Kind() == reflect.Ptr && visited.push(vp) {
@@ -519,16 +624,16 @@ func goToLua(L *lua.State, a interface{}, proxify bool, visited visitor) {
 			copyStructToTable(L, vp, visited)
 		}
 	case reflect.Chan:
-		makeValueProxy(L, vp, cChannelMeta)
+		visited.proxy(vp, cChannelMeta)
 	case reflect.Func:
-		L.PushGoFunction(goToLuaFunction(L, v))
+		L.PushGoFunction(goToLuaFunction(L, v, nil, visited.readOnly))
 	default:
 		if val, ok := v.Interface().(error); ok {
 			L.PushString(val.Error())
 		} else if v.IsNil() {
 			L.PushNil()
 		} else {
-			makeValueProxy(L, vp, cInterfaceMeta)
+			visited.proxy(vp, cInterfaceMeta)
 		}
 	}
 }
@@ -658,10 +763,13 @@ func copyTableToStruct(L *lua.State, idx int, v reflect.Value, visited map[uintp
 	}
 
 	// Associate Lua keys with Go fields: tags have priority over matching field
-	// name.
+	// name. Inaccessible fields are left unset.
 	fields := map[string]string{}
 	for i := 0; i < v.NumField(); i++ {
 		field := t.Field(i)
+		if !isMemberAccessible(t, field.Name) {
+			continue
+		}
 		tag := field.Tag.Get("lua")
 		if tag != "" {
 			fields[tag] = field.Name
@@ -723,6 +831,12 @@ func copyTableToStruct(L *lua.State, idx int, v reflect.Value, visited map[uintp
 // pointer.
 // Userdata that is not a proxy will be converted to a LuaObject if the Go value
 // is an interface or a LuaObject.
+//
+// Lua threads are converted to a Coroutine if the Go value is an interface or a
+// Coroutine, and to a LuaObject if it is a LuaObject. Like the LuaObjects
+// created for functions and userdata, the Coroutine holds a reference to the
+// thread until it is closed: when converting to an interface, call Close on the
+// resulting *Coroutine or *LuaObject, or enable SetAutoRelease.
 func LuaToGo(L *lua.State, idx int, a interface{}) error {
 	// LuaToGo should not pop the Lua stack to be consistent with L.ToString(), etc.
 	// It is also easier in practice when we want to keep working with the value on stack.
@@ -790,6 +904,11 @@ func luaToGo(L *lua.State, idx int, v reflect.Value, visited map[uintptr]reflect
 		v.Set(reflect.ValueOf(L.ToString(idx)))
 	case lua.LUA_TUSERDATA:
 		if isValueProxy(L, idx) {
+			if p := proxyOf(L, idx); p.untyped && vp.Kind() == reflect.Ptr && isPointerToPrimitive(vp) {
+				// References made with luar.ref point to a Go value of the type of
+				// the first pointer they are converted to.
+				adoptType(p, vp.Type())
+			}
 			val, typ := valueOfProxy(L, idx)
 			if val.Interface() == Null {
 				// Special case for Null.
@@ -885,6 +1004,16 @@ func luaToGo(L *lua.State, idx int, v reflect.Value, visited map[uintptr]reflect
 		} else {
 			return ConvError{From: luaDesc(L, idx), To: v.Type()}
 		}
+	case lua.LUA_TTHREAD:
+		if kind == reflect.Interface {
+			v.Set(reflect.ValueOf(newCoroutineFromThread(L, idx)))
+		} else if vp.Type() == reflect.TypeOf(&Coroutine{}) {
+			vp.Set(reflect.ValueOf(newCoroutineFromThread(L, idx)))
+		} else if vp.Type() == reflect.TypeOf(&LuaObject{}) {
+			vp.Set(reflect.ValueOf(NewLuaObject(L, idx)))
+		} else {
+			return ConvError{From: luaDesc(L, idx), To: v.Type()}
+		}
 	default:
 		return ConvError{From: luaDesc(L, idx), To: v.Type()}
 	}
@@ -930,6 +1059,18 @@ func isNewType(t reflect.Type) bool {
 //
 // See GoToLuaProxy's documentation.
 func Register(L *lua.State, table string, values Map) {
+	register(L, table, values, GoToLuaProxy)
+}
+
+// RegisterReadOnly is like Register but the values are pushed as read-only
+// proxies.
+//
+// See GoToLuaReadOnly's documentation.
+func RegisterReadOnly(L *lua.State, table string, values Map) {
+	register(L, table, values, GoToLuaReadOnly)
+}
+
+func register(L *lua.State, table string, values Map, push func(*lua.State, interface{})) {
 	pop := true
 	if table == "*" {
 		pop = false
@@ -945,7 +1086,7 @@ func Register(L *lua.State, table string, values Map) {
 		L.GetGlobal("_G")
 	}
 	for name, val := range values {
-		GoToLuaProxy(L, val)
+		push(L, val)
 		L.SetField(-2, name)
 	}
 	if pop {
@@ -1,6 +1,9 @@
 package luar
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"runtime"
 	"sort"
@@ -8,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aarzilli/golua/lua"
 )
@@ -177,6 +181,144 @@ func runGoTest(t *testing.T, L *lua.State, tdt []goTestData) {
 	}
 }
 
+type account struct {
+	Owner   string
+	Balance int
+	Secret  string
+}
+
+func (a *account) Deposit(n int) {
+	a.Balance += n
+}
+
+func (a *account) Remove() {
+	a.Balance = 0
+}
+
+type bank struct {
+	Main     account
+	Accounts map[string]*account
+	Vault    int
+}
+
+func (b *bank) Lookup(name string) *account {
+	return b.Accounts[name]
+}
+
+func TestAccessPolicy(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	Hide(account{}, "Secret")
+	defer ResetAccess(account{})
+	Expose((*bank)(nil), "Main", "Accounts", "Lookup")
+	defer ResetAccess(bank{})
+	SetAccessFilter(func(t reflect.Type, name string) bool {
+		return name != "Remove"
+	})
+	defer SetAccessFilter(nil)
+
+	acc := &account{Owner: "alice", Balance: 10, Secret: "s3cr3t"}
+	b := &bank{Main: *acc, Accounts: map[string]*account{"alice": acc}}
+	Register(L, "", Map{"acc": acc, "b": b})
+
+	runLuaTest(t, L, []luaTestData{
+		{`acc.Owner`, `'alice'`},
+		{`acc.Secret`, `nil`},
+		{`b.Vault`, `nil`},
+		{`acc.Remove`, `nil`},
+		{`luar.method(acc, "Remove")`, `nil`},
+		{`b.Main.Secret`, `nil`},
+		{`b.Accounts.alice.Secret`, `nil`},
+		{`b.Lookup("alice").Secret`, `nil`},
+		{`b.Lookup("alice").Remove`, `nil`},
+		{`luar.unproxify(acc)`, `{Owner='alice', Balance=10}`},
+	})
+
+	mustDoString(t, L, `acc.Deposit(5)`)
+	if acc.Balance != 15 {
+		t.Errorf("got %v, want %v", acc.Balance, 15)
+	}
+
+	if err := L.DoString(`acc.Secret = "x"`); err == nil {
+		t.Error("missing error when setting a hidden field")
+	}
+	L.SetTop(0)
+	if acc.Secret != "s3cr3t" {
+		t.Errorf("got %q, want %q", acc.Secret, "s3cr3t")
+	}
+
+	// Hidden fields are skipped by pairs and struct copies, and left unset by
+	// table conversions.
+	GoToLua(L, b)
+	L.SetGlobal("copy")
+	mustDoString(t, L, `
+names = {}
+for k in pairs(acc) do
+	names[#names+1] = k
+end
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`names`, `{"Owner", "Balance"}`},
+		{`copy.Main`, `{Owner='alice', Balance=15}`},
+		{`copy.Vault`, `nil`},
+	})
+
+	mustDoString(t, L, `return {Owner = "bob", Secret = "x"}`)
+	var got account
+	if err := LuaToGo(L, -1, &got); err != nil {
+		t.Error(err)
+	}
+	L.Pop(1)
+	if want := (account{Owner: "bob"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAccessPolicyEmbedded(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	Hide((*account)(nil), "Secret", "Remove")
+	defer ResetAccess(account{})
+
+	type savings struct {
+		*account
+		Rate int
+	}
+	acc := &account{Owner: "alice", Balance: 10, Secret: "s3cr3t"}
+	s := &savings{account: acc, Rate: 2}
+	Register(L, "", Map{"s": s})
+
+	mustDoString(t, L, `
+names = {}
+for k in luar.fields(s, true) do
+	names[#names+1] = k
+end
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`s.Owner`, `'alice'`},
+		{`s.Rate`, `2`},
+		{`s.Secret`, `nil`},
+		{`s.Remove`, `nil`},
+		{`luar.method(s, "Remove")`, `nil`},
+		{`names`, `{"Owner", "Balance", "Rate", "Deposit"}`},
+	})
+
+	mustDoString(t, L, `s.Deposit(5)`)
+	if acc.Balance != 15 {
+		t.Errorf("got %v, want %v", acc.Balance, 15)
+	}
+
+	if err := L.DoString(`s.Secret = "x"`); err == nil {
+		t.Error("missing error when setting a hidden embedded field")
+	}
+	L.SetTop(0)
+	if acc.Secret != "s3cr3t" {
+		t.Errorf("got %q, want %q", acc.Secret, "s3cr3t")
+	}
+}
+
 func TestArray(t *testing.T) {
 	L := Init()
 	defer L.Close()
@@ -215,7 +357,7 @@ func TestChan(t *testing.T) {
 		wg.Done()
 	}()
 
-	mustDoString(t, L2, `return c.recv()`)
+	mustDoString(t, L2, `return (c.recv())`)
 	got := L2.ToNumber(-1)
 	want := 17.0
 	if got != want {
@@ -228,6 +370,92 @@ func TestChan(t *testing.T) {
 	checkStack(t, L2)
 }
 
+func TestChanRange(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	produce := func(n int) chan int {
+		c := make(chan int)
+		go func() {
+			for i := 1; i <= n; i++ {
+				c <- i * 10
+			}
+			close(c)
+		}()
+		return c
+	}
+	Register(L, "", Map{"produce": produce})
+
+	mustDoString(t, L, `
+sum, count = 0, 0
+for i, v in ipairs(produce(3)) do
+	sum = sum + v
+	count = i
+end
+values = {}
+for v in produce(2):values() do
+	values[#values+1] = v
+end
+c = luar.chan(3)
+c.send("a")
+c.send("b")
+c.close()
+got = {}
+for _, v in pairs(c) do
+	got[#got+1] = v
+end
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`sum`, `60`},
+		{`count`, `3`},
+		{`values`, `{10, 20}`},
+		{`got`, `{"a", "b"}`},
+	})
+}
+
+func TestChanSelect(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	inbox := make(chan int, 1)
+	outbox := make(chan string, 1)
+	Register(L, "", Map{"inbox": inbox, "outbox": outbox})
+
+	runLuaTest(t, L, []luaTestData{
+		{`select(2, inbox:try_recv())`, `nil`},
+		{`inbox:try_send(17)`, `true`},
+		{`inbox:try_send(18)`, `false`},
+		{`(inbox:try_recv())`, `17`},
+		{`select(2, inbox:recv_timeout(0.01))`, `nil`},
+		{`luar.select{ {inbox, "recv"}, {outbox, "send", "foo"} }`, `2`},
+		{`luar.select{ {outbox, "send", "bar"}, default = function() return "busy" end }`, `"busy"`},
+		{`luar.select{ {inbox, "recv"}, default = true }`, `nil`},
+	})
+	if got := <-outbox; got != "foo" {
+		t.Errorf("got %q, want %q", got, "foo")
+	}
+
+	inbox <- 3
+	outbox <- "full"
+	mustDoString(t, L, `i, v, ok = luar.select{ {outbox, "send", "x"}, {inbox, "recv"} }`)
+	runLuaTest(t, L, []luaTestData{
+		{`i`, `2`},
+		{`v`, `3`},
+		{`ok`, `true`},
+	})
+
+	close(inbox)
+	mustDoString(t, L, `v, ok = inbox:recv()`)
+	runLuaTest(t, L, []luaTestData{
+		{`v`, `nil`},
+		{`ok`, `false`},
+	})
+
+	if err := L.DoString(`luar.select{ {17, "recv"} }`); err == nil || !strings.Contains(err.Error(), "requires a channel") {
+		t.Errorf("got error %v, want 'requires a channel'", err)
+	}
+}
+
 func TestComplex(t *testing.T) {
 	L := Init()
 	defer L.Close()
@@ -257,6 +485,166 @@ type list struct {
 	Next *list
 }
 
+func TestContext(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := DoStringContext(ctx, L, `while true do end`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	checkStack(t, L)
+
+	mustDoString(t, L, `function loop(n) while n > 0 do end return n end`)
+	loop := NewLuaObjectFromName(L, "loop")
+	defer loop.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	var res int
+	err = loop.CallContext(ctx, &res, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	err = loop.CallContext(context.Background(), &res, 0)
+	if err != nil || res != 0 {
+		t.Errorf("got %v, %v, want 0, nil", res, err)
+	}
+
+	// The hook is removed after the call.
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := DoStringContext(ctx, L, `x = 1`); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	mustDoString(t, L, `for i = 1, 10000 do x = x + 1 end`)
+
+	// Errors raised after the cancellation are not attributed to the context.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	Register(L, "", Map{"cancel": cancel})
+	err = DoStringContext(ctx, L, `cancel() error("boom")`)
+	if errors.Is(err, context.Canceled) || err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("got error %v, want boom", err)
+	}
+	checkStack(t, L)
+
+	// Nested calls keep the hook of the enclosing call.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	Register(L, "", Map{"inner": func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		return DoStringContext(ctx, L, `x = 1`)
+	}})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = DoStringContext(ctx, L, `inner() while true do end`)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	checkStack(t, L)
+}
+
+func TestCoroutine(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	const code = `
+function dialog(name)
+	local answer = coroutine.yield("hello " .. name, 1)
+	answer = coroutine.yield("you said " .. answer, 2)
+	return "bye"
+end
+function broken()
+	coroutine.yield()
+	error("boom")
+end
+co = coroutine.create(function() end)
+`
+	mustDoString(t, L, code)
+
+	dialog := NewLuaObjectFromName(L, "dialog")
+	defer dialog.Close()
+	co, err := NewCoroutine(dialog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer co.Close()
+	checkStack(t, L)
+
+	if co.Status() != CoroutineSuspended {
+		t.Errorf("got status %v, want suspended", co.Status())
+	}
+	var line struct {
+		Text string
+		Step int
+	}
+	steps := []struct {
+		arg    interface{}
+		text   string
+		step   int
+		status CoroutineStatus
+	}{
+		{"world", "hello world", 1, CoroutineSuspended},
+		{"yes", "you said yes", 2, CoroutineSuspended},
+		{nil, "bye", 0, CoroutineDead},
+	}
+	for _, s := range steps {
+		if err := co.Resume(&line, s.arg); err != nil {
+			t.Fatal(err)
+		}
+		if line.Text != s.text || line.Step != s.step {
+			t.Errorf("got %+v, want %q %d", line, s.text, s.step)
+		}
+		if co.Status() != s.status {
+			t.Errorf("got status %v, want %v", co.Status(), s.status)
+		}
+	}
+	if err := co.Resume(nil); err != ErrCoroutineDead {
+		t.Errorf("got error %v, want %v", err, ErrCoroutineDead)
+	}
+	checkStack(t, L)
+
+	broken := NewLuaObjectFromName(L, "broken")
+	defer broken.Close()
+	co2, _ := NewCoroutine(broken)
+	defer co2.Close()
+	if err := co2.Resume(nil); err != nil {
+		t.Fatal(err)
+	}
+	err = co2.Resume(nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("got error %v, want boom", err)
+	}
+	if lerr, ok := err.(*LuaError); !ok || lerr.Line != 9 {
+		t.Errorf("got error %#v, want *LuaError at line 9", err)
+	}
+	if co2.Status() != CoroutineDead {
+		t.Errorf("got status %v, want dead", co2.Status())
+	}
+
+	var co3 *Coroutine
+	L.GetGlobal("co")
+	if err := LuaToGo(L, -1, &co3); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	defer co3.Close()
+	if co3.Status() != CoroutineSuspended {
+		t.Errorf("got status %v, want suspended", co3.Status())
+	}
+	checkStack(t, L)
+}
+
 func TestCycleGoToLua(t *testing.T) {
 	L := Init()
 	defer L.Close()
@@ -501,6 +889,89 @@ func TestCycleLuaToGo(t *testing.T) {
 	}
 }
 
+func TestEventLoop(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	loop := NewEventLoop(L)
+	errMissing := errors.New("missing")
+	fetch := func(key string) (string, error) {
+		if key == "" {
+			return "", errMissing
+		}
+		return "value of " + key, nil
+	}
+	Register(L, "", Map{
+		"fetch":      loop.Async(fetch),
+		"mustFetch":  loop.Async(WithErrorPolicy(fetch, ErrorRaise)),
+		"fetchFirst": loop.Async(func(keys ...string) (string, error) { return fetch(keys[0]) }),
+	})
+
+	const code = `
+log = {}
+function main(name)
+	log[#log+1] = fetch(name)
+	local _, err = fetch("")
+	log[#log+1] = err
+	log[#log+1] = fetchFirst("b", "c")
+end
+function broken()
+	mustFetch("")
+	log[#log+1] = "unreachable"
+end
+function guarded()
+	local ok, err = pcall(fetch, "a")
+	guardedLog = {ok, err, fetch("b")}
+end
+`
+	mustDoString(t, L, code)
+
+	main := NewLuaObjectFromName(L, "main")
+	defer main.Close()
+	if err := loop.Spawn(main, "a"); err != nil {
+		t.Fatal(err)
+	}
+	runLuaTest(t, L, []luaTestData{{`log`, `{}`}})
+	if err := loop.Run(); err != nil {
+		t.Fatal(err)
+	}
+	runLuaTest(t, L, []luaTestData{{`log`, `{"value of a", "missing", "value of b"}`}})
+	checkStack(t, L)
+
+	broken := NewLuaObjectFromName(L, "broken")
+	defer broken.Close()
+	if err := loop.Spawn(broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := loop.Run(); !errors.Is(err, errMissing) {
+		t.Errorf("got error %v, want %v", err, errMissing)
+	}
+	runLuaTest(t, L, []luaTestData{{`#log`, `3`}})
+	checkStack(t, L)
+
+	// Async functions cannot yield across pcall, which is a Go function.
+	guarded := NewLuaObjectFromName(L, "guarded")
+	defer guarded.Close()
+	if err := loop.Spawn(guarded); err != nil {
+		t.Fatal(err)
+	}
+	if err := loop.Run(); err != nil {
+		t.Fatal(err)
+	}
+	runLuaTest(t, L, []luaTestData{
+		{`guardedLog[1]`, `false`},
+		{`string.find(guardedLog[2], "yield across") ~= nil`, `true`},
+		{`guardedLog[3]`, `"value of b"`},
+	})
+	checkStack(t, L)
+
+	err := L.DoString(`fetch("x")`)
+	if err == nil || !strings.Contains(err.Error(), "outside of the event loop") {
+		t.Errorf("got error %v, want call outside of the event loop", err)
+	}
+	L.SetTop(0)
+}
+
 // See if Go values are not garbage collected.
 func TestGC(t *testing.T) {
 	L := Init()
@@ -517,6 +988,78 @@ gc()`)
 	})
 }
 
+type node struct {
+	Name string
+	Next *node
+}
+
+func TestProxyIdentity(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	n2 := &node{Name: "b"}
+	n1 := &node{Name: "a", Next: n2}
+	n2.Next = n1
+	getNode := func() *node { return n1 }
+	Register(L, "", Map{"n1": n1, "getNode": getNode})
+	RegisterReadOnly(L, "", Map{"ro": n1})
+
+	mustDoString(t, L, `memo = {}; memo[getNode()] = "seen"`)
+	runLuaTest(t, L, []luaTestData{
+		{`rawequal(n1, getNode())`, `true`},
+		{`rawequal(n1.Next.Next, n1)`, `true`},
+		{`rawequal(n1.Next, n1)`, `false`},
+		{`rawequal(n1, ro)`, `false`},
+		{`memo[n1]`, `"seen"`},
+	})
+}
+
+func TestErrorPolicy(t *testing.T) {
+	L := Init()
+	defer L.Close()
+	defer SetErrorPolicy(ErrorPassThrough)
+
+	errOdd := errors.New("odd")
+	half := func(i int) (int, error) {
+		if i%2 != 0 {
+			return 0, errOdd
+		}
+		return i / 2, nil
+	}
+	Register(L, "", Map{
+		"half":       half,
+		"halfReturn": WithErrorPolicy(half, ErrorReturn),
+		"halfRaise":  WithErrorPolicy(half, ErrorRaise),
+	})
+
+	mustDoString(t, L, `
+n1, err1 = half(3)
+n2, err2 = halfReturn(3)
+raised, err3 = pcall(halfRaise, 3)
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`{n1, err1}`, `{0, "odd"}`},
+		{`{half(4)}`, `{2, nil}`},
+		{`select("#", half(4))`, `2`},
+		{`{n2, err2}`, `{nil, "odd"}`},
+		{`{halfReturn(4)}`, `{2}`},
+		{`select("#", halfReturn(4))`, `1`},
+		{`raised`, `false`},
+		{`err3.Error()`, `"odd"`},
+		{`select("#", halfRaise(4))`, `1`},
+	})
+
+	SetErrorPolicy(ErrorRaise)
+	err := L.DoString(`half(3)`)
+	if err == nil || !strings.Contains(err.Error(), "odd") {
+		t.Errorf("got error %v, want %q", err, "odd")
+	}
+	runLuaTest(t, L, []luaTestData{
+		{`{halfReturn(3)}`, `{nil, "odd"}`},
+		{`select("#", half(4))`, `1`},
+	})
+}
+
 type newArray [2]int
 
 func (a newArray) Split() (int, int) {
@@ -703,6 +1246,85 @@ func TestLuaObject(t *testing.T) {
 	checkStack(t, L)
 }
 
+func TestLuaObjectRelease(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	SetLeakTracking(L, true)
+	SetAutoRelease(L, true)
+	mustDoString(t, L, `t = {1, 2}; function f() end`)
+
+	kept := NewLuaObjectFromName(L, "t")
+	closed := NewLuaObjectFromName(L, "f")
+	closed.Close()
+	objects := OpenLuaObjects(L)
+	if len(objects) != 1 || objects[0].Type != "table" || !strings.Contains(objects[0].Caller, "luar_test.go") {
+		t.Fatalf("got %+v, want the table created in luar_test.go", objects)
+	}
+
+	var f *LuaObject
+	L.GetGlobal("f")
+	if err := LuaToGo(L, -1, &f); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	if n := len(OpenLuaObjects(L)); n != 2 {
+		t.Fatalf("got %v open objects, want 2", n)
+	}
+	f = nil
+
+	for i := 0; i < 20 && len(OpenLuaObjects(L)) > 1; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	objects = OpenLuaObjects(L)
+	if len(objects) != 1 || objects[0].Ref != kept.ref {
+		t.Errorf("got %+v, want only the table", objects)
+	}
+	kept.Close()
+	if n := len(OpenLuaObjects(L)); n != 0 {
+		t.Errorf("got %v open objects, want none", n)
+	}
+
+	// Coroutines created by LuaToGo are tracked too.
+	mustDoString(t, L, `co = coroutine.create(function() end)`)
+	var co *Coroutine
+	L.GetGlobal("co")
+	if err := LuaToGo(L, -1, &co); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	objects = OpenLuaObjects(L)
+	if len(objects) != 1 || objects[0].Type != "thread" {
+		t.Errorf("got %+v, want the coroutine", objects)
+	}
+	co.Close()
+	if n := len(OpenLuaObjects(L)); n != 0 {
+		t.Errorf("got %v open objects, want none", n)
+	}
+
+	// The state is forgotten once both options are disabled.
+	SetLeakTracking(L, false)
+	SetAutoRelease(L, false)
+	if trackerOf(L) != nil {
+		t.Error("tracker should be dropped")
+	}
+	SetLeakTracking(L, true)
+	ForgetObjects(L)
+	if trackerOf(L) != nil {
+		t.Error("tracker should be dropped by ForgetObjects")
+	}
+	checkStack(t, L)
+
+	// Closing the state drops the tracker.
+	L2 := Init()
+	SetLeakTracking(L2, true)
+	L2.Close()
+	if trackerOf(L2) != nil {
+		t.Error("tracker should be dropped when the state is closed")
+	}
+}
+
 func TestLuaObjectMT(t *testing.T) {
 	L := Init()
 	defer L.Close()
@@ -739,14 +1361,111 @@ func TestLuaObjectMT(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	checkStack(t, L)
+	checkStack(t, L)
+
+	err = a.Get(&res, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "F" {
+		t.Errorf(`got %v, want 'F'`, res)
+	}
+	checkStack(t, L)
+}
+
+func TestLuaObjectAccessors(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	const code = `
+config = {
+	server = {host = "localhost", port = 8080, ratio = 0.5, debug = true},
+	names = {"a", "b", "c"},
+}
+point = setmetatable({}, {__eq = function() return true end})
+other = setmetatable({}, getmetatable(point))
+bad = setmetatable({}, {__eq = function() error("no eq") end})
+bad2 = setmetatable({}, getmetatable(bad))
+huge = 2^70
+`
+	mustDoString(t, L, code)
+	config := NewLuaObjectFromName(L, "config")
+	defer config.Close()
+
+	host, err := config.GetString("server", "host")
+	if err != nil || host != "localhost" {
+		t.Errorf("got %q, %v, want localhost", host, err)
+	}
+	port, err := config.Int("server", "port")
+	if err != nil || port != 8080 {
+		t.Errorf("got %v, %v, want 8080", port, err)
+	}
+	ratio, err := config.Float("server", "ratio")
+	if err != nil || ratio != 0.5 {
+		t.Errorf("got %v, %v, want 0.5", ratio, err)
+	}
+	debug, err := config.Bool("server", "debug")
+	if err != nil || !debug {
+		t.Errorf("got %v, %v, want true", debug, err)
+	}
+	if _, err := config.GetString("server", "port"); err == nil {
+		t.Error("String on a number should fail")
+	}
+	if _, err := config.Int("server", "ratio"); err == nil {
+		t.Error("Int on a fractional number should fail")
+	}
+	if _, err := config.Bool("server", "missing"); err == nil {
+		t.Error("Bool on nil should fail")
+	}
+
+	names, _ := config.GetObject("names")
+	defer names.Close()
+	if n, err := names.Len(); err != nil || n != 3 {
+		t.Errorf("got length %v, %v, want 3", n, err)
+	}
+	if names.Type() != lua.LUA_TTABLE || names.IsNil() {
+		t.Errorf("got type %v, want table", names.Type())
+	}
+	keys, err := config.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+	if !reflect.DeepEqual(keys, []interface{}{"names", "server"}) {
+		t.Errorf("got keys %v, want names and server", keys)
+	}
+	twelve := NewLuaObjectFromValue(L, 12)
+	defer twelve.Close()
+	L.Pop(1)
+	if got := fmt.Sprintf("%v %q", names, twelve); !strings.HasPrefix(got, "table: ") || !strings.HasSuffix(got, ` "12"`) {
+		t.Errorf("got %q, want tostring output", got)
+	}
+	var stringer fmt.Stringer = twelve
+	if got := stringer.String(); got != "12" {
+		t.Errorf("got %q, want 12", got)
+	}
 
-	err = a.Get(&res, 1)
-	if err != nil {
-		t.Fatal(err)
+	point := NewLuaObjectFromName(L, "point")
+	defer point.Close()
+	other := NewLuaObjectFromName(L, "other")
+	defer other.Close()
+	if eq, err := point.Equals(other); err != nil || !eq {
+		t.Errorf("got %v, %v, want equal with __eq", eq, err)
 	}
-	if res != "F" {
-		t.Errorf(`got %v, want 'F'`, res)
+	if eq, err := point.RawEquals(other); err != nil || eq {
+		t.Errorf("got %v, %v, want not raw equal", eq, err)
+	}
+	bad := NewLuaObjectFromName(L, "bad")
+	defer bad.Close()
+	bad2 := NewLuaObjectFromName(L, "bad2")
+	defer bad2.Close()
+	if _, err := bad.Equals(bad2); err == nil || !strings.Contains(err.Error(), "no eq") {
+		t.Errorf("got error %v, want no eq", err)
+	}
+	huge := NewLuaObjectFromName(L, "huge")
+	defer huge.Close()
+	if _, err := huge.Int(); err == nil {
+		t.Error("Int on an overflowing number should fail")
 	}
 	checkStack(t, L)
 }
@@ -841,6 +1560,169 @@ end
 	}
 }
 
+func TestLuaObjectCallError(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	errBad := errors.New("bad")
+	Register(L, "", Map{"gofail": func() { panic(errBad) }})
+
+	const code = `
+function index(x)
+	return x.field
+end
+function raise()
+	error("boom")
+end
+function raiseTable()
+	error({code = 17})
+end
+function callGo()
+	gofail()
+end
+`
+	mustDoString(t, L, code)
+
+	tests := []struct {
+		name    string
+		message string
+		line    int
+	}{
+		{"index", `[string "..."]:3: attempt to index local 'x' (a nil value)`, 3},
+		{"raise", `[string "..."]:6: boom`, 6},
+		{"raiseTable", `Lua value`, 9},
+	}
+	for _, test := range tests {
+		f := NewLuaObjectFromName(L, test.name)
+		err := f.Call(nil)
+		f.Close()
+		lerr, ok := err.(*LuaError)
+		if !ok {
+			t.Errorf("%s: got error %#v, want *LuaError", test.name, err)
+			continue
+		}
+		if !strings.HasPrefix(lerr.Message, test.message) {
+			t.Errorf("%s: got message %q, want %q", test.name, lerr.Message, test.message)
+		}
+		if lerr.Chunk != `[string "..."]` || lerr.Line != test.line {
+			t.Errorf("%s: got location %v:%v, want %v", test.name, lerr.Chunk, lerr.Line, test.line)
+		}
+		if !strings.Contains(lerr.Traceback, "stack traceback") {
+			t.Errorf("%s: missing traceback in %q", test.name, lerr.Traceback)
+		}
+		if lerr.Err != nil {
+			t.Errorf("%s: got wrapped error %v, want nil", test.name, lerr.Err)
+		}
+		checkStack(t, L)
+	}
+
+	f := NewLuaObjectFromName(L, "callGo")
+	defer f.Close()
+	err := f.Call(nil)
+	var lerr *LuaError
+	if !errors.As(err, &lerr) || lerr.Err == nil {
+		t.Errorf("got error %#v, want *LuaError wrapping a Go error", err)
+	}
+	checkStack(t, L)
+}
+
+func TestLuaObjectCallWithoutXpcall(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	// Like golua's OpenLibs, in case it leaves 'xpcall' around.
+	mustDoString(t, L, `unsafe_xpcall = unsafe_xpcall or xpcall; xpcall = nil
+function add(a, b) return a + b end`)
+	add := NewLuaObjectFromName(L, "add")
+	defer add.Close()
+	var sum int
+	if err := add.Call(&sum, 17, 18); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 35 {
+		t.Errorf("got %v, want %v", sum, 35)
+	}
+	checkStack(t, L)
+
+	L2 := Init()
+	defer L2.Close()
+	mustDoString(t, L2, `xpcall, unsafe_xpcall = nil, nil
+function f() end`)
+	f := NewLuaObjectFromName(L2, "f")
+	defer f.Close()
+	if err := f.Call(nil); err == nil {
+		t.Error("missing error without xpcall")
+	}
+	checkStack(t, L2)
+}
+
+type codeError struct {
+	Code int
+}
+
+func (e *codeError) Error() string {
+	return "code " + strconv.Itoa(e.Code)
+}
+
+func TestLuaObjectCallGoError(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	errNotFound := errors.New("not found")
+	Register(L, "", Map{
+		"find":  func(key string) int { panic(errNotFound) },
+		"fail":  func() { panic(&codeError{17}) },
+		"slice": []int{17},
+	})
+
+	const code = `
+ok, err = pcall(find, "x")
+msg = err.Error()
+okValues = {pcall(function(a) return a, 2 end, 1)}
+okTable, errTable = pcall(error, {code = 1})
+okRange, errRange = pcall(function() return slice[10] end)
+function rethrow()
+	local ok, err = pcall(fail)
+	error(err)
+end
+function callFind()
+	return find("y")
+end
+`
+	mustDoString(t, L, code)
+	runLuaTest(t, L, []luaTestData{
+		{`ok`, `false`},
+		{`msg`, `"not found"`},
+		{`tostring(err)`, `"not found"`},
+		{`okValues`, `{true, 1, 2}`},
+		{`okTable`, `false`},
+		{`errTable.code`, `1`},
+		{`okRange`, `false`},
+		{`type(errRange)`, `"string"`},
+		{`errRange:find("index out of range") ~= nil`, `true`},
+	})
+
+	rethrow := NewLuaObjectFromName(L, "rethrow")
+	defer rethrow.Close()
+	err := rethrow.Call(nil)
+	var cerr *codeError
+	if !errors.As(err, &cerr) || cerr.Code != 17 {
+		t.Errorf("got error %#v, want to match *codeError", err)
+	}
+	checkStack(t, L)
+
+	callFind := NewLuaObjectFromName(L, "callFind")
+	defer callFind.Close()
+	err = callFind.Call(nil)
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("got error %#v, want to match %v", err, errNotFound)
+	}
+	if err == nil || err.Error() != `[string "..."]:12: not found` {
+		t.Errorf("got error %q, want location and message", err)
+	}
+	checkStack(t, L)
+}
+
 func TestLuaObjectCallMT(t *testing.T) {
 	L := Init()
 	defer L.Close()
@@ -1280,6 +2162,119 @@ func TestProxyArray(t *testing.T) {
 	}
 }
 
+type version struct {
+	Parts []int
+}
+
+func newVersion(parts ...int) version {
+	return version{Parts: parts}
+}
+
+func (v version) Compare(w version) int {
+	for i := 0; i < len(v.Parts) && i < len(w.Parts); i++ {
+		if v.Parts[i] != w.Parts[i] {
+			return v.Parts[i] - w.Parts[i]
+		}
+	}
+	return len(v.Parts) - len(w.Parts)
+}
+
+func TestProxyCompare(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	Register(L, "", Map{
+		"d1":         time.Second,
+		"d2":         time.Minute,
+		"newVersion": newVersion,
+		"sl":         []int{1, 2},
+		"m":          map[string]int{"a": 1},
+		"t1":         time.Unix(0, 0).UTC(),
+		"t2":         time.Unix(0, 0).In(time.FixedZone("X", 3600)),
+		"s":          myStringA("foo"),
+		"tt":         newStringA("foo"),
+	})
+
+	runLuaTest(t, L, []luaTestData{
+		{`d1 <= d2`, `true`},
+		{`d2 <= d1`, `false`},
+		{`d1 >= d1`, `true`},
+		{`s <= tt`, `true`},
+		{`newVersion(1, 2) < newVersion(1, 10)`, `true`},
+		{`newVersion(1, 2) <= newVersion(1, 2)`, `true`},
+		{`newVersion(2) > newVersion(1, 10)`, `true`},
+		{`newVersion(1, 2) == newVersion(1, 2)`, `true`},
+		{`newVersion(1, 2) == newVersion(1, 3)`, `false`},
+		{`sl == sl`, `true`},
+		{`sl == sl.slice(1, 2)`, `false`},
+		{`m == m`, `true`},
+		{`t1 == t2`, `true`},
+		{`t1 <= t2`, `true`},
+		{`t1 < t2`, `false`},
+	})
+
+	err := L.DoString(`return sl < sl`)
+	if err == nil || !strings.Contains(err.Error(), "cannot compare") {
+		t.Errorf("got %v, want comparison error", err)
+	}
+	L.SetTop(0)
+}
+
+type perm uint32
+
+const (
+	permRead perm = 1 << iota
+	permWrite
+	permExec
+)
+
+func TestProxyBitwise(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	Register(L, "", Map{
+		"r":  permRead,
+		"w":  permWrite,
+		"x":  permExec,
+		"rw": permRead | permWrite,
+		"i":  myIntA(-7),
+	})
+	GoToLuaProxy(L, 1.5)
+	L.SetGlobal("f")
+
+	runLuaTest(t, L, []luaTestData{
+		{`luar.bor(r, w)`, `rw`},
+		{`luar.band(rw, w)`, `w`},
+		{`luar.band(rw, x) == luar.band(r, x)`, `true`},
+		{`luar.bxor(rw, r)`, `w`},
+		{`luar.band(luar.bnot(r), rw)`, `w`},
+		{`luar.shl(r, 2)`, `x`},
+		{`luar.shr(x, 1)`, `w`},
+		{`luar.idiv(i, 2) == luar.idiv(i, i/i*2)`, `true`},
+		{`luar.band(6, 3)`, `2`},
+		{`luar.shl(1, 4)`, `16`},
+		{`luar.idiv(7.5, 2)`, `3`},
+		{`luar.idiv(-7, 2)`, `-4`},
+		{`type(luar.shl(1, r))`, `'number'`},
+		{`type(luar.shl(r, i/i))`, `'number<luar.perm>'`},
+		{`type(f + 1)`, `'number<float64>'`},
+	})
+
+	var got myIntA
+	mustDoString(t, L, `return luar.idiv(i, 2)`)
+	if err := LuaToGo(L, -1, &got); err != nil || got != -3 {
+		t.Errorf("got %v (%v), want -3", got, err)
+	}
+	L.Pop(1)
+
+	for _, code := range []string{`return luar.shl(r, -1)`, `return luar.band(r, 1.5)`, `return luar.idiv(i, 0)`} {
+		if err := L.DoString(code); err == nil {
+			t.Errorf("missing error from %q", code)
+		}
+		L.SetTop(0)
+	}
+}
+
 type myIntA int
 
 func newIntA(i int) myIntA {
@@ -1443,6 +2438,177 @@ end
 	runLuaTest(t, L, []luaTestData{{`p`, `{foo="bar", baz="qux"}`}})
 }
 
+func TestProxyMapMethods(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	m := map[string]int{"a": 1, "b": 2, "c": 3, "keys": 4}
+	Register(L, "", Map{"m": m})
+
+	mustDoString(t, L, `
+function method(name, ...) return luar.method(m, name)(...) end
+vals = method("values")
+table.sort(vals)
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`m.keys`, `4`},
+		{`m.has`, `nil`},
+		{`m.values`, `nil`},
+		{`#method("keys")`, `4`},
+		{`method("has", "a")`, `true`},
+		{`method("has", "z")`, `false`},
+		{`method("has", 17)`, `false`},
+		{`method("has", m)`, `false`},
+		{`vals`, `{1, 2, 3, 4}`},
+		{`method("table")`, `{a=1, b=2, c=3, keys=4}`},
+	})
+
+	mustDoString(t, L, `m.a = nil; method("delete", "b"); method("delete", "nonexistent")`)
+	want := map[string]int{"c": 3, "keys": 4}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	mustDoString(t, L, `m.c = luar.null`)
+	want = map[string]int{"c": 0, "keys": 4}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	mustDoString(t, L, `method("clear")`)
+	if len(m) != 0 {
+		t.Errorf("got %v, want empty map", m)
+	}
+}
+
+func TestProxyRef(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	counter := 0
+	name := "foo"
+	count := func(items []string, n *int) {
+		*n += len(items)
+	}
+	rename := func(s *string) {
+		*s = strings.ToUpper(*s)
+	}
+	Register(L, "", Map{
+		"counter": &counter,
+		"name":    &name,
+		"count":   count,
+		"rename":  rename,
+	})
+
+	mustDoString(t, L, `
+counter.set(counter.get() + 1)
+counter.value = counter.value + 1
+name:set("bar")
+`)
+	if counter != 2 {
+		t.Errorf("got %v, want 2", counter)
+	}
+	if name != "bar" {
+		t.Errorf("got %q, want %q", name, "bar")
+	}
+
+	mustDoString(t, L, `
+n = luar.ref(1)
+count({"a", "b"}, n)
+count({"c"}, n)
+s = luar.ref()
+s.value = "baz"
+rename(s)
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`n.value`, `4`},
+		{`s:get()`, `'BAZ'`},
+		{`type(n)`, `'number<*int>'`},
+	})
+
+	if err := L.DoString(`counter.value = "x"`); err == nil || !strings.Contains(err.Error(), "ref requires int value type") {
+		t.Errorf("got error %v, want 'ref requires int value type'", err)
+	}
+}
+
+type tally struct {
+	N int
+}
+
+func (t *tally) Incr() {
+	t.N++
+}
+
+var errTally = errors.New("tally failed")
+
+func (t *tally) Fail() {
+	panic(errTally)
+}
+
+// Modifications of values which are not addressable, such as map values, are
+// written back to the parent.
+func TestProxyWriteBack(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	people := map[string]person{"alice": {"Alice", 30}}
+	contacts := map[string]Contact{"bob": {person{"Bob", 40}}}
+	tallies := map[int]tally{1: {}}
+	things := []interface{}{person{"Carol", 50}}
+	Register(L, "", Map{
+		"people":   people,
+		"contacts": contacts,
+		"tallies":  tallies,
+		"things":   things,
+	})
+
+	mustDoString(t, L, `
+people.alice.Age = 31
+contacts.bob.Person.Name = "Robert"
+tallies[1].Incr()
+for _, v in ipairs(tallies) do v.Incr() end
+things[1].Name = "Caroline"
+`)
+	if got := people["alice"].Age; got != 31 {
+		t.Errorf("got %v, want 31", got)
+	}
+	if got := contacts["bob"].Person.Name; got != "Robert" {
+		t.Errorf("got %q, want %q", got, "Robert")
+	}
+	if got := tallies[1].N; got != 2 {
+		t.Errorf("got %v, want 2", got)
+	}
+	if got := things[0].(person).Name; got != "Caroline" {
+		t.Errorf("got %q, want %q", got, "Caroline")
+	}
+
+	// Copies of deleted or replaced values are not written back.
+	mustDoString(t, L, `
+local a = people.alice
+people.alice = nil
+a.Age = 32
+local t1, t2 = tallies[1], tallies[1]
+t1.Incr()
+t2.Incr()
+t2.Incr()
+`)
+	if _, ok := people["alice"]; ok {
+		t.Error("deleted key written back")
+	}
+	if got := tallies[1].N; got != 3 {
+		t.Errorf("got %v, want 3", got)
+	}
+
+	// Errors of methods called on copies are preserved.
+	mustDoString(t, L, `function fail() tallies[1].Fail() end`)
+	fail := NewLuaObjectFromName(L, "fail")
+	defer fail.Close()
+	if err := fail.Call(nil); !errors.Is(err, errTally) {
+		t.Errorf("got error %v, want %v", err, errTally)
+	}
+	checkStack(t, L)
+}
+
 type mySlice []int
 
 func (m *mySlice) Foo() int {
@@ -1465,6 +2631,69 @@ func TestProxySlice(t *testing.T) {
 		{`a.slice(3, 5)[1]`, `18`},
 		{`a.slice(3, 5)[2]`, `19`},
 	})
+
+	// Slices that can be set grow when assigning past the end.
+	holder := &struct{ Items []string }{}
+	items := []int{1}
+	Register(L, "", Map{"holder": holder, "items": &items})
+	mustDoString(t, L, `
+holder.Items[#holder.Items+1] = "x"
+holder.Items[#holder.Items+1] = "y"
+items[#items+1] = 2
+`)
+	if want := []string{"x", "y"}; !reflect.DeepEqual(holder.Items, want) {
+		t.Errorf("got %v, want %v", holder.Items, want)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(items, want) {
+		t.Errorf("got %v, want %v", items, want)
+	}
+	if err := L.DoString(`a[#a+1] = 1`); err == nil || !strings.Contains(err.Error(), "index out of range") {
+		t.Errorf("got error %v, want index out of range", err)
+	}
+}
+
+func TestProxySliceMethods(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	a := []int{3, 1, 2}
+	words := []string{"pear", "apple", "fig"}
+	Register(L, "", Map{"a": a, "words": words, "empty": []int{}})
+
+	mustDoString(t, L, `
+a.sort()
+b = a.insert(4)
+b = b:insert(1, 0)
+b, removed = b.remove(2)
+c = b.copy()
+c.reverse()
+words:sort(function(x, y) return #x < #y end)
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`a.concat(",")`, `"1,2,3"`},
+		{`b:concat(",")`, `"0,2,3,4"`},
+		{`b.concat(",", 2, 3)`, `"2,3"`},
+		{`c.concat(",")`, `"4,3,2,0"`},
+		{`empty:concat(",")`, `""`},
+		{`b.concat(",", 3, 2)`, `""`},
+		{`b.concat(",", 9, 2)`, `""`},
+		{`removed`, `1`},
+		{`b.find(3)`, `3`},
+		{`b.find(17)`, `nil`},
+		{`b.find("x")`, `nil`},
+		{`words.concat(" ")`, `"fig pear apple"`},
+	})
+
+	for code, want := range map[string]string{
+		`b.remove(17)`:        "slice remove: index out of range",
+		`b.insert("x")`:       "slice requires int value type",
+		`b.concat(",", 1, 5)`: "slice concat: index out of range",
+	} {
+		err := L.DoString(code)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", code, err, want)
+		}
+	}
 }
 
 func TestProxyString(t *testing.T) {
@@ -1494,6 +2723,33 @@ end
 		{`a.slice(2, 3)`, `newStringA('a')`},
 		{`a.slice(2, 3)[1]`, `'a'`},
 	})
+
+	// Lua's string library.
+	Register(L, "", Map{"b": myStringA("hello world")})
+	runLuaTest(t, L, []luaTestData{
+		{`b:upper()`, `newStringA('HELLO WORLD')`},
+		{`b.upper()`, `newStringA('HELLO WORLD')`},
+		{`b:sub(1, 5)`, `newStringA('hello')`},
+		{`(b:find("wor"))`, `7`},
+		{`select(2, b:gsub("o", "0"))`, `2`},
+		{`(b:gsub("o", "0"))`, `newStringA('hell0 w0rld')`},
+		{`b:len()`, `11`},
+		{`b.nonexistent`, `nil`},
+	})
+
+	// Runes and bytes: "naïveté" has 7 runes and 9 bytes.
+	runLuaTest(t, L, []luaTestData{
+		{`#a`, `9`},
+		{`a:runelen()`, `7`},
+		{`a.runes()`, `{'n', 'a', 'ï', 'v', 'e', 't', 'é'}`},
+		{`#a:bytes()`, `9`},
+		{`a:bytes()[3]`, `0xc3`},
+		{`a:runeslice(3, 5)`, `newStringA('ïv')`},
+		{`a:runeslice(6)`, `newStringA('té')`},
+	})
+	if err := L.DoString(`a:runeslice(3, 9)`); err == nil || !strings.Contains(err.Error(), "slice bounds out of range") {
+		t.Errorf("got error %v, want slice bounds out of range", err)
+	}
 }
 
 // Get and set public fields in struct proxies.
@@ -1561,8 +2817,155 @@ func TestProxyStruct(t *testing.T) {
 
 	mustDoString(t, L, `address.City = "newCity"`)
 	runLuaTest(t, L, []luaTestData{
-		{`address.City`, `'newCity'`},
+		{`address.City.value`, `'newCity'`},
+	})
+}
+
+func TestProxyStructPairs(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	type record struct {
+		ID      int `lua:"id"`
+		Name    string
+		Owner   person
+		private int
+	}
+	r := &record{ID: 7, Name: "foo", Owner: person{"Alice", 30}}
+	Register(L, "", Map{"r": r})
+
+	mustDoString(t, L, `
+keys = {}
+for k, v in pairs(r) do
+	keys[#keys+1] = k
+end
+withMethods = {}
+for k in luar.fields(r.Owner, true) do
+	withMethods[#withMethods+1] = k
+end
+r.id = 8
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`keys`, `{"id", "Name", "Owner"}`},
+		{`withMethods`, `{"Name", "Age", "GetName"}`},
+		{`r.id`, `8`},
+		{`r.ID`, `8`},
+	})
+	if r.ID != 8 {
+		t.Errorf("got %v, want 8", r.ID)
+	}
+
+	mustDoString(t, L, `for k, v in pairs(r) do if k == "Owner" then v.Name = "Bob" end end`)
+	if r.Owner.Name != "Bob" {
+		t.Errorf("got %q, want %q", r.Owner.Name, "Bob")
+	}
+
+	// Promoted fields are listed after their embedded field, except when
+	// shadowed.
+	type Base struct {
+		Kind  string `lua:"kind"`
+		Name  string
+		Extra *record
+	}
+	type derived struct {
+		Base
+		Name string
+	}
+	d := &derived{Base: Base{Kind: "k", Name: "base"}, Name: "derived"}
+	Register(L, "", Map{"d": d})
+	mustDoString(t, L, `
+dkeys = {}
+for k in pairs(d) do
+	dkeys[#dkeys+1] = k
+end
+d.kind = "other"
+`)
+	runLuaTest(t, L, []luaTestData{
+		{`dkeys`, `{"Base", "kind", "Extra", "Name"}`},
+		{`d.Name`, `'derived'`},
+		{`d.Base.Name`, `'base'`},
+		{`d.kind`, `'other'`},
+	})
+	if d.Kind != "other" {
+		t.Errorf("got %q, want %q", d.Kind, "other")
+	}
+}
+
+type config struct {
+	Name    string
+	Owner   person
+	Tags    []string
+	Limits  map[string]int
+	Updates chan int
+}
+
+func (c config) Title() string {
+	return "config " + c.Name
+}
+
+func (c config) TagList() []string {
+	return c.Tags
+}
+
+func (c config) LimitMap() map[string]int {
+	return c.Limits
+}
+
+func TestReadOnly(t *testing.T) {
+	L := Init()
+	defer L.Close()
+
+	cfg := &config{
+		Name:    "main",
+		Owner:   person{"Alice", 30},
+		Tags:    []string{"a", "b"},
+		Limits:  map[string]int{"conn": 10},
+		Updates: make(chan int, 1),
+	}
+	RegisterReadOnly(L, "", Map{"cfg": cfg})
+
+	runLuaTest(t, L, []luaTestData{
+		{`cfg.Name`, `'main'`},
+		{`cfg.Owner.Name`, `'Alice'`},
+		{`cfg.Tags[2]`, `'b'`},
+		{`cfg.Limits.conn`, `10`},
+		{`cfg.Title()`, `'config main'`},
+		{`cfg.TagList()[1]`, `'a'`},
+		{`cfg.Tags.slice(1, 2)[1]`, `'a'`},
 	})
+
+	for _, code := range []string{
+		`cfg.Name = "other"`,
+		`cfg.Owner.Name = "Bob"`,
+		`cfg.Tags[1] = "z"`,
+		`cfg.Tags.slice(1, 2)[1] = "z"`,
+		`cfg.Tags.append("c")`,
+		`cfg.Limits.conn = 0`,
+		`cfg.TagList()[1] = "z"`,
+		`cfg.LimitMap().conn = 0`,
+		`cfg.Owner.GetName()`,
+		`cfg.Updates.send(1)`,
+		`cfg.Updates.close()`,
+	} {
+		err := L.DoString(code)
+		if err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Errorf("got %v, want read-only error from %q", err, code)
+		}
+		L.SetTop(0)
+	}
+
+	want := config{Name: "main", Owner: person{"Alice", 30}, Tags: []string{"a", "b"}, Limits: map[string]int{"conn": 10}, Updates: cfg.Updates}
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Errorf("got %#v, want %#v", *cfg, want)
+	}
+
+	// The same value pushed with GoToLuaProxy remains writable.
+	GoToLuaProxy(L, cfg)
+	L.SetGlobal("rw")
+	mustDoString(t, L, `rw.Name = "other"`)
+	if cfg.Name != "other" {
+		t.Errorf("got %q, want %q", cfg.Name, "other")
+	}
 }
 
 // nil, bool, number, string
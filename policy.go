@@ -0,0 +1,213 @@
+package luar
+
+// Access policy for the fields and methods of Go values exposed to Lua.
+
+import (
+	"reflect"
+	"sync"
+)
+
+// accessRules holds the fields and methods of a type that Lua can access.
+type accessRules struct {
+	// allowed is nil when all names are allowed.
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+var (
+	accessMap    = map[reflect.Type]*accessRules{}
+	accessFilter func(t reflect.Type, name string) bool
+	accessmu     sync.RWMutex
+)
+
+// accessType returns the type the rules of 'a' are stored under.
+// 'a' can be a value or a reflect.Type. Pointers are dereferenced so that the
+// rules of T also apply to *T.
+func accessType(a interface{}) reflect.Type {
+	t, ok := a.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(a)
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func accessRulesOf(t reflect.Type) *accessRules {
+	r, ok := accessMap[t]
+	if !ok {
+		r = &accessRules{denied: map[string]bool{}}
+		accessMap[t] = r
+	}
+	return r
+}
+
+// Expose restricts the fields and methods accessible from Lua for the type of
+// 'a' to 'names'. Subsequent calls extend the list.
+//
+// 'a' can be a value of the type, a pointer to it (e.g. '(*os.File)(nil)') or
+// its reflect.Type. The rules of a type apply to pointers to that type.
+//
+// Inaccessible fields and methods behave as if they did not exist: indexing
+// them returns nil, setting them raises an error, they are skipped by 'pairs'
+// and when copying structs to tables, and tables converted to the type leave
+// them unset. This applies to every value of the type, including values
+// reached from other proxies and structs embedding the type.
+func Expose(a interface{}, names ...string) {
+	accessmu.Lock()
+	defer accessmu.Unlock()
+	r := accessRulesOf(accessType(a))
+	if r.allowed == nil {
+		r.allowed = map[string]bool{}
+	}
+	for _, name := range names {
+		r.allowed[name] = true
+	}
+}
+
+// Hide makes the fields and methods 'names' of the type of 'a' inaccessible
+// from Lua.
+//
+// See Expose for the details.
+func Hide(a interface{}, names ...string) {
+	accessmu.Lock()
+	defer accessmu.Unlock()
+	r := accessRulesOf(accessType(a))
+	for _, name := range names {
+		r.denied[name] = true
+	}
+}
+
+// ResetAccess removes the rules set by Expose and Hide for the type of 'a'.
+func ResetAccess(a interface{}) {
+	accessmu.Lock()
+	defer accessmu.Unlock()
+	delete(accessMap, accessType(a))
+}
+
+// SetAccessFilter sets a function deciding whether the field or method 'name'
+// of type 't' is accessible from Lua. It is consulted after the rules of
+// Expose and Hide. 't' is never a pointer type.
+//
+// A nil filter removes the current one.
+func SetAccessFilter(f func(t reflect.Type, name string) bool) {
+	accessmu.Lock()
+	defer accessmu.Unlock()
+	accessFilter = f
+}
+
+// isAccessible reports whether the field or method 'name' of type 't' is
+// accessible from Lua.
+func isAccessible(t reflect.Type, name string) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	accessmu.RLock()
+	r := accessMap[t]
+	filter := accessFilter
+	allowed := r == nil || (r.allowed == nil || r.allowed[name]) && !r.denied[name]
+	accessmu.RUnlock()
+	if !allowed {
+		return false
+	}
+	return filter == nil || filter(t, name)
+}
+
+// isMemberAccessible is like isAccessible but also applies the rules of the
+// types through which the field or method 'name' is promoted: the embedded
+// fields leading to it must be accessible, and so must 'name' in each embedded
+// type. For example, hiding the method 'Close' of *os.File also hides it on
+// the structs embedding *os.File.
+func isMemberAccessible(t reflect.Type, name string) bool {
+	if !isAccessible(t, name) {
+		return false
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || !hasAccessRules() {
+		return true
+	}
+	var path []int
+	if f, ok := t.FieldByName(name); ok {
+		path = f.Index[:len(f.Index)-1]
+	} else {
+		path = promotedMethodPath(t, name)
+	}
+	for _, i := range path {
+		f := t.Field(i)
+		if !isAccessible(t, f.Name) {
+			return false
+		}
+		t = f.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if !isAccessible(t, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAccessRules reports whether any rule or filter is set.
+func hasAccessRules() bool {
+	accessmu.RLock()
+	defer accessmu.RUnlock()
+	return len(accessMap) > 0 || accessFilter != nil
+}
+
+// promotedMethodPath returns the indices of the embedded fields through which
+// the method 'name' is promoted to the struct type 't', or nil if none. As in
+// Go, the shallowest embedded field declaring the method wins, and the method
+// is not promoted if several fields declare it at that depth.
+//
+// Methods declared by 't' itself cannot be told apart from promoted ones with
+// reflection: they are also subject to the rules of the embedded type declaring
+// a method of the same name, if any.
+func promotedMethodPath(t reflect.Type, name string) []int {
+	type embedding struct {
+		t    reflect.Type
+		path []int
+	}
+	level := []embedding{{t, nil}}
+	visited := map[reflect.Type]bool{t: true}
+	for len(level) > 0 {
+		var found []int
+		count := 0
+		var next []embedding
+		for _, e := range level {
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				if !f.Anonymous {
+					continue
+				}
+				path := append(append([]int(nil), e.path...), i)
+				ft := f.Type
+				for ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				mt := ft
+				if ft.Kind() != reflect.Interface {
+					mt = reflect.PtrTo(ft)
+				}
+				if _, ok := mt.MethodByName(name); ok {
+					found = path
+					count++
+				} else if ft.Kind() == reflect.Struct && !visited[ft] {
+					visited[ft] = true
+					next = append(next, embedding{ft, path})
+				}
+			}
+		}
+		if count == 1 {
+			return found
+		}
+		if count > 1 {
+			return nil
+		}
+		level = next
+	}
+	return nil
+}
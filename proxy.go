@@ -2,9 +2,12 @@ package luar
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/aarzilli/golua/lua"
 )
@@ -14,6 +17,14 @@ import (
 type valueProxy struct {
 	v reflect.Value
 	t reflect.Type
+	// readOnly proxies cannot be used to modify the Go value.
+	readOnly bool
+	// untyped references were created from Lua with luar.ref. They adopt the
+	// type of the first Go pointer they are converted to.
+	untyped bool
+	// writeBack stores the modified value into its parent when the proxy refers
+	// to a copy, e.g. of a map value. It is nil otherwise.
+	writeBack func()
 }
 
 const (
@@ -25,14 +36,92 @@ const (
 	cStructMeta    = "structMT"
 	cInterfaceMeta = "interfaceMT"
 	cChannelMeta   = "channelMT"
+	cRefMeta       = "refMT"
 )
 
 var (
 	proxyIdCounter uintptr
 	proxyMap       = map[uintptr]*valueProxy{}
-	proxymu        sync.RWMutex
+	// proxyTypes numbers the types of the cached proxies.
+	proxyTypes = map[reflect.Type]int{}
+	proxymu    sync.RWMutex
+
+	// structInfos caches the fields of the struct types, see structInfoOf.
+	structInfos   = map[reflect.Type]*structInfo{}
+	structInfosmu sync.RWMutex
 )
 
+// structInfo describes the fields of a struct type as seen from Lua.
+type structInfo struct {
+	// index maps the keys of the fields to their index sequence. Keys are the
+	// "lua" tags and the field names, tags having priority. Fields promoted
+	// from embedded structs are included.
+	index map[string][]int
+	// fields lists the fields reachable by their key, the "lua" tag if any or
+	// the name, in declaration order. Promoted fields follow their embedded
+	// field.
+	fields []structField
+}
+
+type structField struct {
+	key   string
+	name  string
+	index []int
+}
+
+// Registry field of the per-state proxy cache.
+const cProxyCache = "luar.proxies"
+
+// adoptType retypes the untyped reference 'p' to 'ptrType', a pointer to a
+// primitive type. It reports whether the current value could be converted.
+func adoptType(p *valueProxy, ptrType reflect.Type) bool {
+	elem := p.v.Elem()
+	if elem.Kind() == reflect.Interface {
+		elem = elem.Elem()
+	}
+	nv := reflect.New(ptrType.Elem())
+	if elem.IsValid() {
+		if !elem.Type().ConvertibleTo(ptrType.Elem()) {
+			return false
+		}
+		nv.Elem().Set(elem.Convert(ptrType.Elem()))
+	}
+	p.v, p.t, p.untyped = nv, ptrType, false
+	return true
+}
+
+// callCompareMethod calls the method 'name' of 'v' with 'arg' if it has the
+// signature of a comparison method, i.e. one argument of the type of 'arg' (or
+// of the type 'arg' points to) and one result.
+func callCompareMethod(v reflect.Value, name string, arg reflect.Value) (reflect.Value, bool) {
+	method := v.MethodByName(name)
+	if !method.IsValid() && v.CanAddr() {
+		method = v.Addr().MethodByName(name)
+	}
+	if !method.IsValid() {
+		return reflect.Value{}, false
+	}
+	mt := method.Type()
+	if mt.NumIn() != 1 || mt.NumOut() != 1 {
+		return reflect.Value{}, false
+	}
+	in := mt.In(0)
+	if !arg.Type().AssignableTo(in) {
+		if arg.Kind() != reflect.Ptr || arg.IsNil() || !arg.Elem().Type().AssignableTo(in) {
+			return reflect.Value{}, false
+		}
+		arg = arg.Elem()
+	}
+	return method.Call([]reflect.Value{arg})[0], true
+}
+
+// checkWritable raises an error if the proxy is read-only.
+func checkWritable(L *lua.State, p *valueProxy, op string) {
+	if p.readOnly {
+		L.RaiseError(fmt.Sprintf("%s: read-only proxy (%v)", op, p.t))
+	}
+}
+
 // commonKind returns the kind to which v1 and v2 can be converted with the
 // least information loss.
 func commonKind(v1, v2 reflect.Value) reflect.Kind {
@@ -47,8 +136,64 @@ func commonKind(v1, v2 reflect.Value) reflect.Kind {
 	return reflect.Float64
 }
 
+// integerKind returns the kind to which v1 and v2 are converted for bitwise
+// operations.
+func integerKind(v1, v2 reflect.Value) reflect.Kind {
+	if unsizedKind(v1) == reflect.Uint64 && unsizedKind(v2) == reflect.Uint64 {
+		return reflect.Uint64
+	}
+	return reflect.Int64
+}
+
+// isCopiedValue reports whether 'v' is proxied as a copy by goToLua, that is a
+// struct or an array of a user-defined type which is not addressable, possibly
+// wrapped in an interface.
+func isCopiedValue(v reflect.Value) bool {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	} else if v.CanAddr() {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return true
+	case reflect.Array:
+		return reflect.ArrayOf(v.Len(), v.Type().Elem()) != v.Type()
+	}
+	return false
+}
+
+// isIntegerValue reports whether 'v' is of integer kind.
+func isIntegerValue(v reflect.Value) bool {
+	k := unsizedKind(v)
+	return k == reflect.Int64 || k == reflect.Uint64
+}
+
+// isIntegral reports whether 'v' is a number with an exact integer value.
+func isIntegral(v reflect.Value) bool {
+	switch unsizedKind(v) {
+	case reflect.Int64, reflect.Uint64:
+		return true
+	case reflect.Float64:
+		return v.Float() == math.Trunc(v.Float())
+	}
+	return false
+}
+
+// isPointerToPrimitive reports whether 'v' is a non-nil pointer to a boolean,
+// a real number or a string of a predeclared type.
 func isPointerToPrimitive(v reflect.Value) bool {
-	return v.Kind() == reflect.Ptr && v.Elem().IsValid() && v.Elem().Type() != nil
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false
+	}
+	switch unsizedKind(v.Elem()) {
+	case reflect.Bool, reflect.Int64, reflect.Uint64, reflect.Float64, reflect.String:
+		return !isNewType(v.Elem().Type())
+	}
+	return false
 }
 
 func isPredeclaredType(t reflect.Type) bool {
@@ -78,7 +223,8 @@ func luaToGoValue(L *lua.State, idx int) (reflect.Value, reflect.Type) {
 	return reflect.ValueOf(a), reflect.TypeOf(a)
 }
 
-func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
+// makeProxy pushes the proxy 'p' with the 'proxyMT' metatable.
+func makeProxy(L *lua.State, p *valueProxy, proxyMT string) {
 	// The metatable needs be set up in the Lua state before the proxy is created,
 	// otherwise closing the state will fail on calling the garbage collector. Not
 	// really sure why this happens though...
@@ -97,6 +243,7 @@ func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
 			L.NewMetaTable(proxyMT)
 			L.SetMetaMethod("__index", interface__index)
 			L.SetMetaMethod("__lt", number__lt)
+			L.SetMetaMethod("__le", number__le)
 			L.SetMetaMethod("__add", number__add)
 			L.SetMetaMethod("__sub", number__sub)
 			L.SetMetaMethod("__mul", number__mul)
@@ -104,6 +251,13 @@ func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
 			L.SetMetaMethod("__mod", number__mod)
 			L.SetMetaMethod("__pow", number__pow)
 			L.SetMetaMethod("__unm", number__unm)
+			L.SetMetaMethod("__idiv", number__idiv)
+			L.SetMetaMethod("__band", number__band)
+			L.SetMetaMethod("__bor", number__bor)
+			L.SetMetaMethod("__bxor", number__bxor)
+			L.SetMetaMethod("__bnot", number__bnot)
+			L.SetMetaMethod("__shl", number__shl)
+			L.SetMetaMethod("__shr", number__shr)
 			flagValue()
 		case cComplexMeta:
 			L.NewMetaTable(proxyMT)
@@ -120,6 +274,7 @@ func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
 			L.SetMetaMethod("__index", string__index)
 			L.SetMetaMethod("__len", string__len)
 			L.SetMetaMethod("__lt", string__lt)
+			L.SetMetaMethod("__le", string__le)
 			L.SetMetaMethod("__concat", string__concat)
 			L.SetMetaMethod("__ipairs", string__ipairs)
 			L.SetMetaMethod("__pairs", string__ipairs)
@@ -131,6 +286,8 @@ func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
 			L.SetMetaMethod("__len", slicemap__len)
 			L.SetMetaMethod("__ipairs", slice__ipairs)
 			L.SetMetaMethod("__pairs", slice__ipairs)
+			L.SetMetaMethod("__lt", proxy__lt)
+			L.SetMetaMethod("__le", proxy__le)
 			flagValue()
 		case cMapMeta:
 			L.NewMetaTable(proxyMT)
@@ -139,40 +296,147 @@ func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
 			L.SetMetaMethod("__len", slicemap__len)
 			L.SetMetaMethod("__ipairs", map__ipairs)
 			L.SetMetaMethod("__pairs", map__pairs)
+			L.SetMetaMethod("__lt", proxy__lt)
+			L.SetMetaMethod("__le", proxy__le)
 			flagValue()
 		case cStructMeta:
 			L.NewMetaTable(proxyMT)
 			L.SetMetaMethod("__index", struct__index)
 			L.SetMetaMethod("__newindex", struct__newindex)
+			L.SetMetaMethod("__pairs", struct__pairs)
+			L.SetMetaMethod("__lt", proxy__lt)
+			L.SetMetaMethod("__le", proxy__le)
 			flagValue()
 		case cInterfaceMeta:
 			L.NewMetaTable(proxyMT)
 			L.SetMetaMethod("__index", interface__index)
+			L.SetMetaMethod("__lt", proxy__lt)
+			L.SetMetaMethod("__le", proxy__le)
 			flagValue()
 		case cChannelMeta:
 			L.NewMetaTable(proxyMT)
 			L.SetMetaMethod("__index", channel__index)
+			L.SetMetaMethod("__ipairs", channel__ipairs)
+			L.SetMetaMethod("__pairs", channel__ipairs)
+			flagValue()
+		case cRefMeta:
+			L.NewMetaTable(proxyMT)
+			L.SetMetaMethod("__index", ref__index)
+			L.SetMetaMethod("__newindex", ref__newindex)
 			flagValue()
 		}
 	}
+	L.Pop(1)
+
+	// Return the existing proxy, if any, so that the same Go value always yields
+	// the same userdata.
+	key := proxyCacheKey(p)
+	if key != "" {
+		pushProxyCache(L)
+		L.GetField(-1, key)
+		if !L.IsNil(-1) {
+			L.Remove(-2)
+			return
+		}
+		L.Pop(2)
+	}
 
 	proxymu.Lock()
 	id := proxyIdCounter
 	proxyIdCounter++
-	proxyMap[id] = &valueProxy{ v: v, t: v.Type() }
+	proxyMap[id] = p
 	proxymu.Unlock()
 
-	L.Pop(1)
 	rawptr := L.NewUserdata(reflect.TypeOf(id).Size())
 	*(*uintptr)(rawptr) = id
 	L.LGetMetaTable(proxyMT)
 	L.SetMetaTable(-2)
+
+	if key != "" {
+		pushProxyCache(L)
+		L.PushValue(-2)
+		L.SetField(-2, key)
+		L.Pop(1)
+	}
+}
+
+func makeValueProxy(L *lua.State, v reflect.Value, proxyMT string) {
+	makeProxy(L, &valueProxy{v: v, t: v.Type()}, proxyMT)
+}
+
+// methodArgs returns the index of the first argument of a call to a proxy
+// method so that both 'p.f(x)' and 'p:f(x)' are supported. 'self' is the
+// address of the proxy userdata as returned by L.ToPointer.
+func methodArgs(L *lua.State, self uintptr) int {
+	if L.Type(1) == lua.LUA_TUSERDATA && L.ToPointer(1) == self {
+		return 2
+	}
+	return 1
+}
+
+// proxyCacheKey returns the key of 'p' in the proxy cache, or "" if 'p' has no
+// stable identity. Pointers, maps and channels are identified by the value
+// they point to, other addressable values by their address. The type is part
+// of the key since a struct and its first field share the same address.
+func proxyCacheKey(p *valueProxy) string {
+	if p.untyped {
+		return ""
+	}
+	var ptr uintptr
+	switch {
+	case (p.v.Kind() == reflect.Ptr || p.v.Kind() == reflect.Map || p.v.Kind() == reflect.Chan) && !p.v.IsNil():
+		ptr = p.v.Pointer()
+	case p.v.CanAddr():
+		ptr = p.v.UnsafeAddr()
+	default:
+		return ""
+	}
+
+	proxymu.Lock()
+	id, ok := proxyTypes[p.t]
+	if !ok {
+		id = len(proxyTypes)
+		proxyTypes[p.t] = id
+	}
+	proxymu.Unlock()
+
+	return fmt.Sprintf("%x:%d:%t", ptr, id, p.readOnly)
 }
 
-func pushGoMethod(L *lua.State, name string, v reflect.Value) {
+// proxyOf returns the proxy at index 'idx'.
+func proxyOf(L *lua.State, idx int) *valueProxy {
+	proxyId := *(*uintptr)(L.ToUserdata(idx))
+
+	proxymu.RLock()
+	val, ok := proxyMap[proxyId]
+	proxymu.RUnlock()
+
+	if !ok {
+		L.RaiseError(fmt.Sprintf("No value proxy in arg #%d", idx))
+	}
+
+	return val
+}
+
+// pushGoMethod pushes the method 'name' of 'v', the value of proxy 'p'.
+//
+// Methods with a pointer receiver cannot be called on read-only proxies, and
+// the results of the other methods are read-only. Inaccessible methods are
+// pushed as nil, see Expose.
+func pushGoMethod(L *lua.State, name string, v reflect.Value, p *valueProxy) {
+	if !isMemberAccessible(v.Type(), name) {
+		L.PushNil()
+		return
+	}
 	method := v.MethodByName(name)
+	ptrReceiver := false
+	if method.IsValid() && v.Kind() == reflect.Ptr {
+		_, ok := v.Type().Elem().MethodByName(name)
+		ptrReceiver = !ok
+	}
 	if !method.IsValid() {
 		t := v.Type()
+		ptrReceiver = true
 		// Could not resolve this method. Perhaps it's defined on the pointer?
 		if t.Kind() != reflect.Ptr {
 			if v.CanAddr() {
@@ -191,7 +455,173 @@ func pushGoMethod(L *lua.State, name string, v reflect.Value) {
 			return
 		}
 	}
-	GoToLua(L, method)
+	if ptrReceiver && p.readOnly {
+		L.PushGoFunction(func(L *lua.State) int {
+			L.RaiseError(fmt.Sprintf("method %v has a pointer receiver: read-only proxy (%v)", name, p.t))
+			return 0
+		})
+		return
+	}
+	if ptrReceiver && p.writeBack != nil {
+		// The method may modify the copy.
+		L.PushGoFunction(func(L *lua.State) int {
+			GoToLua(L, method)
+			L.Insert(1)
+			if err := L.Call(L.GetTop()-1, lua.LUA_MULTRET); err != nil {
+				if gerr, ok := err.(*goError); ok {
+					err = gerr.err
+				}
+				raiseGoError(L, err)
+			}
+			storeBack(p)
+			return L.GetTop()
+		})
+		return
+	}
+	// Results of methods of read-only proxies are read-only too.
+	pushNested(L, p, method)
+}
+
+// pushMapMethod pushes the map proxy method 'name' of 'p', or nil if there is
+// no such method. The method is bound to 'p': its arguments start at 1.
+func pushMapMethod(L *lua.State, p *valueProxy, name string) {
+	v, t := p.v, p.t
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+		t = t.Elem()
+	}
+	// toKey converts the argument at 'idx' to a map key.
+	toKey := func(L *lua.State, idx int) (reflect.Value, bool) {
+		key := reflect.New(t.Key())
+		if err := LuaToGo(L, idx, key.Interface()); err != nil {
+			return reflect.Value{}, false
+		}
+		return key.Elem(), true
+	}
+
+	var f lua.LuaGoFunction
+	switch name {
+	case "clear":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "map clear")
+			for _, key := range v.MapKeys() {
+				v.SetMapIndex(key, reflect.Value{})
+			}
+			return 0
+		}
+	case "delete":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "map delete")
+			if key, ok := toKey(L, 1); ok {
+				v.SetMapIndex(key, reflect.Value{})
+			}
+			return 0
+		}
+	case "has":
+		f = func(L *lua.State) int {
+			key, ok := toKey(L, 1)
+			L.PushBoolean(ok && v.MapIndex(key).IsValid())
+			return 1
+		}
+	case "keys":
+		f = func(L *lua.State) int {
+			L.CreateTable(v.Len(), 0)
+			for i, key := range v.MapKeys() {
+				pushNested(L, p, key)
+				L.RawSeti(-2, i+1)
+			}
+			return 1
+		}
+	case "table":
+		f = func(L *lua.State) int {
+			L.CreateTable(0, v.Len())
+			for _, key := range v.MapKeys() {
+				pushNested(L, p, key)
+				pushNested(L, p, v.MapIndex(key))
+				L.SetTable(-3)
+			}
+			return 1
+		}
+	case "values":
+		f = func(L *lua.State) int {
+			L.CreateTable(v.Len(), 0)
+			for i, key := range v.MapKeys() {
+				pushNested(L, p, v.MapIndex(key))
+				L.RawSeti(-2, i+1)
+			}
+			return 1
+		}
+	default:
+		L.PushNil()
+		return
+	}
+	L.PushGoFunction(f)
+}
+
+// pushNested pushes 'a', a value reached from the proxy 'p' such as a field or
+// an element. Proxies of read-only proxies are read-only. Proxies of copies
+// write back to the parent of 'p' like 'p' does.
+func pushNested(L *lua.State, p *valueProxy, a interface{}) {
+	if v, ok := a.(reflect.Value); ok && v.Kind() == reflect.Interface && v.CanSet() && isCopiedValue(v) {
+		pushNestedCopy(L, p, v, func() reflect.Value { return v }, v.Set)
+		return
+	}
+	visited := newVisitor(L)
+	visited.readOnly = p.readOnly
+	visited.writeBack = p.writeBack
+	goToLua(L, a, true, visited)
+	visited.close()
+}
+
+// pushNestedCopy is like pushNested for 'val', a value which cannot be
+// modified in place such as a map value. If it is proxied as a copy, 'store'
+// is called with the copy after each modification through the proxy.
+//
+// The copy is only stored while 'load' returns the value the copy was last
+// synchronized with: once the parent slot is deleted or modified by other
+// means, e.g. through another copy, modifications are no longer written back.
+func pushNestedCopy(L *lua.State, p *valueProxy, val reflect.Value, load func() reflect.Value, store func(reflect.Value)) {
+	if p.readOnly || !isCopiedValue(val) {
+		pushNested(L, p, val)
+		return
+	}
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	cp := reflect.New(val.Type()).Elem()
+	cp.Set(val)
+	last := reflect.New(val.Type()).Elem()
+	last.Set(val)
+	detached := false
+	parent := p.writeBack
+	visited := newVisitor(L)
+	visited.writeBack = func() {
+		if detached {
+			return
+		}
+		cur := load()
+		if cur.IsValid() && cur.Kind() == reflect.Interface {
+			cur = cur.Elem()
+		}
+		if !cur.IsValid() || cur.Type() != last.Type() || !reflect.DeepEqual(cur.Interface(), last.Interface()) {
+			// The parent slot has changed since the copy was taken.
+			detached = true
+			return
+		}
+		store(cp)
+		last.Set(cp)
+		if parent != nil {
+			parent()
+		}
+	}
+	goToLua(L, cp, true, visited)
+	visited.close()
+}
+
+// pushMapValue pushes 'val', the value at 'key' of the map 'v' of proxy 'p'.
+// Copies write back to the map, see pushNestedCopy.
+func pushMapValue(L *lua.State, p *valueProxy, v, key, val reflect.Value) {
+	pushNestedCopy(L, p, val, func() reflect.Value { return v.MapIndex(key) }, func(cp reflect.Value) { v.SetMapIndex(key, cp) })
 }
 
 // pushNumberValue pushes the number resulting from an arithmetic operation.
@@ -217,7 +647,350 @@ func pushNumberValue(L *lua.State, a interface{}, t1, t2 reflect.Type) {
 	}
 }
 
-func slicer(L *lua.State, v reflect.Value, metatable string) lua.LuaGoFunction {
+// pushOperatorValue is like pushNumberValue for the operators which are also
+// Go functions of the 'luar' table, e.g. 'luar.band', and may thus be called
+// without proxy: the result of plain numbers is a plain number.
+func pushOperatorValue(L *lua.State, a interface{}, t1, t2 reflect.Type) {
+	if isPredeclaredType(t1) && isPredeclaredType(t2) {
+		L.PushNumber(valueToNumber(L, reflect.ValueOf(a)))
+		return
+	}
+	pushNumberValue(L, a, t1, t2)
+}
+
+// pushProxyCache pushes the proxy cache of the state, a table with weak values
+// mapping the keys returned by proxyCacheKey to proxies.
+func pushProxyCache(L *lua.State) {
+	L.GetField(lua.LUA_REGISTRYINDEX, cProxyCache)
+	if !L.IsNil(-1) {
+		return
+	}
+	L.Pop(1)
+	L.NewTable()
+	L.NewTable()
+	L.PushString("v")
+	L.SetField(-2, "__mode")
+	L.SetMetaTable(-2)
+	L.PushValue(-1)
+	L.SetField(lua.LUA_REGISTRYINDEX, cProxyCache)
+}
+
+// pushRefValue pushes the value the reference proxy 'p' points to.
+func pushRefValue(L *lua.State, p *valueProxy) {
+	GoToLua(L, p.v.Elem())
+}
+
+// pushSliceMethod pushes the slice proxy method 'name' of 'v', the dereferenced
+// value of proxy 'p'. It returns false and pushes nothing if there is no such
+// method. 'self' is the address of the proxy userdata.
+//
+// Methods returning a slice return a new slice header, as 'append' does.
+func pushSliceMethod(L *lua.State, p *valueProxy, v reflect.Value, self uintptr, name string) bool {
+	te := v.Type().Elem()
+	n := v.Len()
+	// toElem converts the argument at 'idx' to an element.
+	toElem := func(L *lua.State, idx int) reflect.Value {
+		elem := reflect.New(te)
+		err := LuaToGo(L, idx, elem.Interface())
+		if err != nil {
+			L.RaiseError(fmt.Sprintf("slice requires %v value type", te))
+		}
+		return elem.Elem()
+	}
+	// toIndex returns the 0-based index of the argument at 'idx', 'def' if absent.
+	toIndex := func(L *lua.State, idx, def, max int, op string) int {
+		i := def
+		if !L.IsNoneOrNil(idx) {
+			i = L.CheckInteger(idx) - 1
+		}
+		if i < 0 || i > max {
+			L.RaiseError(op + ": index out of range")
+		}
+		return i
+	}
+	pushSlice := func(L *lua.State, s reflect.Value) {
+		makeProxy(L, &valueProxy{v: s, t: s.Type(), readOnly: p.readOnly}, cSliceMeta)
+	}
+
+	var f lua.LuaGoFunction
+	switch name {
+	case "concat":
+		f = func(L *lua.State) int {
+			arg := methodArgs(L, self)
+			sep := L.OptString(arg, "")
+			// As in table.concat, an empty range is valid whatever the bounds.
+			if L.OptInteger(arg+1, 1) > L.OptInteger(arg+2, n) {
+				L.PushString("")
+				return 1
+			}
+			i := toIndex(L, arg+1, 0, n, "slice concat")
+			j := toIndex(L, arg+2, n-1, n-1, "slice concat")
+			var buf []byte
+			for k := i; k <= j; k++ {
+				if k > i {
+					buf = append(buf, sep...)
+				}
+				elem := v.Index(k)
+				if elem.Kind() == reflect.Interface {
+					elem = elem.Elem()
+				}
+				switch unsizedKind(elem) {
+				case reflect.Int64:
+					buf = strconv.AppendInt(buf, elem.Int(), 10)
+				case reflect.Uint64:
+					buf = strconv.AppendUint(buf, elem.Uint(), 10)
+				case reflect.Float64:
+					buf = strconv.AppendFloat(buf, elem.Float(), 'g', 14, 64)
+				case reflect.String:
+					buf = append(buf, elem.String()...)
+				default:
+					L.RaiseError(fmt.Sprintf("slice concat: invalid value (at index %d)", k+1))
+				}
+			}
+			L.PushString(string(buf))
+			return 1
+		}
+	case "copy":
+		f = func(L *lua.State) int {
+			s := reflect.MakeSlice(v.Type(), n, n)
+			reflect.Copy(s, v)
+			pushSlice(L, s)
+			return 1
+		}
+	case "find":
+		f = func(L *lua.State) int {
+			arg := methodArgs(L, self)
+			elem := reflect.New(te)
+			if err := LuaToGo(L, arg, elem.Interface()); err == nil {
+				start := toIndex(L, arg+1, 0, n, "slice find")
+				for k := start; k < n; k++ {
+					if valuesEqual(v.Index(k).Interface(), elem.Elem().Interface()) {
+						L.PushInteger(int64(k + 1))
+						return 1
+					}
+				}
+			}
+			L.PushNil()
+			return 1
+		}
+	case "insert":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "slice insert")
+			arg := methodArgs(L, self)
+			// Like table.insert, the position is optional.
+			i, val := n, reflect.Value{}
+			if L.GetTop() > arg {
+				i = toIndex(L, arg, n, n, "slice insert")
+				val = toElem(L, arg+1)
+			} else {
+				val = toElem(L, arg)
+			}
+			s := reflect.Append(v, reflect.Zero(te))
+			reflect.Copy(s.Slice(i+1, n+1), s.Slice(i, n))
+			s.Index(i).Set(val)
+			pushSlice(L, s)
+			return 1
+		}
+	case "remove":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "slice remove")
+			if n == 0 {
+				pushSlice(L, v)
+				return 1
+			}
+			i := toIndex(L, methodArgs(L, self), n-1, n-1, "slice remove")
+			removed := reflect.New(te).Elem()
+			removed.Set(v.Index(i))
+			reflect.Copy(v.Slice(i, n), v.Slice(i+1, n))
+			// Do not keep a reference to the last element in the backing array.
+			v.Index(n - 1).Set(reflect.Zero(te))
+			pushSlice(L, v.Slice(0, n-1))
+			pushNested(L, p, removed)
+			return 2
+		}
+	case "reverse":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "slice reverse")
+			swap := reflect.Swapper(v.Interface())
+			for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+				swap(i, j)
+			}
+			return 0
+		}
+	case "sort":
+		f = func(L *lua.State) int {
+			checkWritable(L, p, "slice sort")
+			arg := methodArgs(L, self)
+			less := func(i, j int) bool {
+				return valuesLessDefault(L, v.Index(i), v.Index(j))
+			}
+			if !L.IsNoneOrNil(arg) {
+				L.CheckType(arg, lua.LUA_TFUNCTION)
+				less = func(i, j int) bool {
+					L.PushValue(arg)
+					pushNested(L, p, v.Index(i))
+					pushNested(L, p, v.Index(j))
+					if err := L.Call(2, 1); err != nil {
+						L.RaiseError(err.Error())
+					}
+					defer L.Pop(1)
+					return L.ToBoolean(-1)
+				}
+			}
+			sort.Slice(v.Interface(), less)
+			return 0
+		}
+	default:
+		return false
+	}
+	L.PushGoFunction(f)
+	return true
+}
+
+// stringMethodsOfType are the functions of Lua's string library whose first
+// result is re-wrapped in the type of the string proxy.
+var stringMethodsOfType = map[string]bool{
+	"gsub":    true,
+	"lower":   true,
+	"rep":     true,
+	"reverse": true,
+	"sub":     true,
+	"upper":   true,
+}
+
+// pushStringMethod pushes a function calling 'name' from Lua's string library
+// with the value of string proxy 'p' as first argument. It returns false and
+// pushes nothing if there is no such function. 'self' is the address of the
+// proxy userdata.
+func pushStringMethod(L *lua.State, p *valueProxy, self uintptr, name string) bool {
+	L.GetGlobal("string")
+	if !L.IsTable(-1) {
+		L.Pop(1)
+		return false
+	}
+	L.GetField(-1, name)
+	isFunc := L.IsFunction(-1)
+	L.Pop(2)
+	if !isFunc {
+		return false
+	}
+
+	v := reflect.Indirect(p.v)
+	L.PushGoFunction(func(L *lua.State) int {
+		arg := methodArgs(L, self)
+		nargs := L.GetTop() - arg + 1
+		base := L.GetTop()
+		// The string table is looked up at call time like Lua's own string
+		// metatable does.
+		L.GetGlobal("string")
+		L.GetField(-1, name)
+		L.Remove(-2)
+		L.PushString(v.String())
+		for i := arg; i < arg+nargs; i++ {
+			L.PushValue(i)
+		}
+		if err := L.Call(nargs+1, lua.LUA_MULTRET); err != nil {
+			L.RaiseError(err.Error())
+		}
+		nresults := L.GetTop() - base
+		if nresults > 0 && stringMethodsOfType[name] && L.Type(base+1) == lua.LUA_TSTRING {
+			result := reflect.ValueOf(L.ToString(base + 1)).Convert(v.Type())
+			makeProxy(L, &valueProxy{v: result, t: result.Type(), readOnly: p.readOnly}, cStringMeta)
+			L.Replace(base + 1)
+		}
+		return nresults
+	})
+	return true
+}
+
+// pushStringUTF8Method pushes the rune- or byte-aware method 'name' of string
+// proxy 'p': bytes, runelen, runes or runeslice. 'self' is the address of the
+// proxy userdata.
+//
+// Invalid UTF-8 bytes count as one rune each, as in Go's 'range' loops.
+func pushStringUTF8Method(L *lua.State, p *valueProxy, self uintptr, name string) {
+	v := reflect.Indirect(p.v)
+	str := v.String()
+	// runeOffsets returns the byte offsets of the runes of 'str', followed by
+	// len(str).
+	runeOffsets := func() []int {
+		offsets := make([]int, 0, len(str)+1)
+		for i := 0; i < len(str); {
+			offsets = append(offsets, i)
+			_, size := utf8.DecodeRuneInString(str[i:])
+			i += size
+		}
+		return append(offsets, len(str))
+	}
+
+	var f lua.LuaGoFunction
+	switch name {
+	case "bytes":
+		f = func(L *lua.State) int {
+			L.CreateTable(len(str), 0)
+			for i := 0; i < len(str); i++ {
+				L.PushInteger(int64(str[i]))
+				L.RawSeti(-2, i+1)
+			}
+			return 1
+		}
+	case "runelen":
+		f = func(L *lua.State) int {
+			L.PushInteger(int64(utf8.RuneCountInString(str)))
+			return 1
+		}
+	case "runes":
+		f = func(L *lua.State) int {
+			offsets := runeOffsets()
+			L.CreateTable(len(offsets)-1, 0)
+			for i := 0; i < len(offsets)-1; i++ {
+				L.PushString(str[offsets[i]:offsets[i+1]])
+				L.RawSeti(-2, i+1)
+			}
+			return 1
+		}
+	case "runeslice":
+		f = func(L *lua.State) int {
+			arg := methodArgs(L, self)
+			offsets := runeOffsets()
+			n := len(offsets) - 1
+			i := L.CheckInteger(arg) - 1
+			j := n
+			if !L.IsNoneOrNil(arg + 1) {
+				j = L.CheckInteger(arg+1) - 1
+			}
+			if i < 0 || i > n || i > j || j > n {
+				L.RaiseError("slice bounds out of range")
+			}
+			vn := v.Slice(offsets[i], offsets[j])
+			makeProxy(L, &valueProxy{v: vn, t: vn.Type(), readOnly: p.readOnly}, cStringMeta)
+			return 1
+		}
+	}
+	L.PushGoFunction(f)
+}
+
+// setRefValue sets the value the reference proxy 'p' points to from the Lua
+// value at 'idx'.
+func setRefValue(L *lua.State, p *valueProxy, idx int) {
+	checkWritable(L, p, "ref set")
+	err := LuaToGo(L, idx, p.v.Interface())
+	if err != nil {
+		L.RaiseError(fmt.Sprintf("ref requires %v value type", p.t.Elem()))
+	}
+}
+
+// shiftCount returns the right operand of a shift operation.
+func shiftCount(L *lua.State, v reflect.Value) uint {
+	n := valueToInteger(L, v)
+	if n < 0 {
+		L.RaiseError("negative shift amount")
+	}
+	return uint(n)
+}
+
+// slicer returns the 'slice' method of 'v', the dereferenced value of proxy 'p'.
+func slicer(L *lua.State, p *valueProxy, v reflect.Value, metatable string) lua.LuaGoFunction {
 	return func(L *lua.State) int {
 		L.CheckInteger(1)
 		L.CheckInteger(2)
@@ -227,11 +1000,157 @@ func slicer(L *lua.State, v reflect.Value, metatable string) lua.LuaGoFunction {
 			L.RaiseError("slice bounds out of range")
 		}
 		vn := v.Slice(i, j)
-		makeValueProxy(L, vn, metatable)
+		makeProxy(L, &valueProxy{v: vn, t: vn.Type(), readOnly: p.readOnly}, metatable)
 		return 1
 	}
 }
 
+// storeBack stores the value of proxy 'p' into its parent if 'p' refers to a
+// copy. It must be called after each modification through 'p'.
+func storeBack(p *valueProxy) {
+	if p.writeBack != nil {
+		p.writeBack()
+	}
+}
+
+// structFieldByKey returns the field of the struct 'v' with the key 'key', see
+// structInfo, and its name. The returned field is invalid if there is no such
+// field or if it is promoted through a nil pointer.
+func structFieldByKey(v reflect.Value, key string) (reflect.Value, string) {
+	index, ok := structInfoOf(v.Type()).index[key]
+	if !ok {
+		return reflect.Value{}, key
+	}
+	name := v.Type().FieldByIndex(index).Name
+	field := v
+	for _, i := range index {
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				return reflect.Value{}, name
+			}
+			field = field.Elem()
+		}
+		field = field.Field(i)
+	}
+	return field, name
+}
+
+// structInfoOf returns the fields of the struct type 't'.
+func structInfoOf(t reflect.Type) *structInfo {
+	structInfosmu.RLock()
+	info := structInfos[t]
+	structInfosmu.RUnlock()
+	if info != nil {
+		return info
+	}
+
+	// List the fields in declaration order, keeping those which Go resolves
+	// by name: shadowed and ambiguous promoted fields are left out.
+	var all []reflect.StructField
+	embedding := map[reflect.Type]bool{t: true}
+	var walk func(st reflect.Type, prefix []int)
+	walk = func(st reflect.Type, prefix []int) {
+		for i := 0; i < st.NumField(); i++ {
+			f := st.Field(i)
+			f.Index = append(append([]int(nil), prefix...), i)
+			if g, ok := t.FieldByName(f.Name); ok && reflect.DeepEqual(g.Index, f.Index) {
+				all = append(all, f)
+			}
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && ft.Kind() == reflect.Struct && !embedding[ft] {
+				embedding[ft] = true
+				walk(ft, f.Index)
+				delete(embedding, ft)
+			}
+		}
+	}
+	walk(t, nil)
+
+	info = &structInfo{index: map[string][]int{}}
+	byDepth := append([]reflect.StructField(nil), all...)
+	sort.SliceStable(byDepth, func(i, j int) bool { return len(byDepth[i].Index) < len(byDepth[j].Index) })
+	for _, f := range byDepth {
+		if tag := f.Tag.Get("lua"); tag != "" {
+			if _, ok := info.index[tag]; !ok {
+				info.index[tag] = f.Index
+			}
+		}
+	}
+	for _, f := range all {
+		if _, ok := info.index[f.Name]; !ok {
+			info.index[f.Name] = f.Index
+		}
+	}
+	for _, f := range all {
+		key := f.Tag.Get("lua")
+		if key == "" {
+			key = f.Name
+		}
+		if reflect.DeepEqual(info.index[key], f.Index) {
+			info.fields = append(info.fields, structField{key: key, name: f.Name, index: f.Index})
+		}
+	}
+
+	structInfosmu.Lock()
+	structInfos[t] = info
+	structInfosmu.Unlock()
+	return info
+}
+
+// structPairs pushes an iterator over the accessible exported fields of struct
+// proxy 'p' in declaration order, including the fields promoted from embedded
+// structs. Keys are the "lua" tags if any, the field names otherwise. If
+// 'withMethods' is true, the methods follow the fields in lexicographic order.
+func structPairs(L *lua.State, p *valueProxy, withMethods bool) {
+	vp := p.v
+	v := reflect.Indirect(vp)
+	st := v.Type()
+
+	var fields []structField
+	for _, f := range structInfoOf(st).fields {
+		if field, _ := structFieldByKey(v, f.key); field.IsValid() && field.CanSet() && isMemberAccessible(st, f.name) {
+			fields = append(fields, f)
+		}
+	}
+	var methods []string
+	if withMethods {
+		mt := reflect.PtrTo(st)
+		for i := 0; i < mt.NumMethod(); i++ {
+			if name := mt.Method(i).Name; isMemberAccessible(st, name) {
+				methods = append(methods, name)
+			}
+		}
+	}
+
+	idx := -1
+	iter := func(L *lua.State) int {
+		idx++
+		if idx < len(fields) {
+			key := fields[idx].key
+			field, _ := structFieldByKey(v, key)
+			L.PushString(key)
+			if field.IsValid() {
+				pushNested(L, p, field)
+			} else {
+				// An embedded pointer was set to nil during the iteration.
+				L.PushNil()
+			}
+			return 2
+		}
+		if idx-len(fields) < len(methods) {
+			name := methods[idx-len(fields)]
+			L.PushString(name)
+			pushGoMethod(L, name, vp, p)
+			return 2
+		}
+		return 0
+	}
+	L.PushGoFunction(iter)
+}
+
 // Shorthand for kind-switches.
 func unsizedKind(v reflect.Value) reflect.Kind {
 	switch v.Kind() {
@@ -248,17 +1167,8 @@ func unsizedKind(v reflect.Value) reflect.Kind {
 }
 
 func valueOfProxy(L *lua.State, idx int) (reflect.Value, reflect.Type) {
-	proxyId := *(*uintptr)(L.ToUserdata(idx))
-
-	proxymu.RLock()
-	val, ok := proxyMap[proxyId]
-	proxymu.RUnlock()
-
-	if !ok {
-		L.RaiseError(fmt.Sprintf("No value proxy in arg #%d", idx))
-	}
-
-	return val.v, val.t
+	p := proxyOf(L, idx)
+	return p.v, p.t
 }
 
 func valueToComplex(L *lua.State, v reflect.Value) complex128 {
@@ -268,6 +1178,22 @@ func valueToComplex(L *lua.State, v reflect.Value) complex128 {
 	return complex(valueToNumber(L, v), 0)
 }
 
+// valueToInteger converts 'v' to an integer, raising an error if it has no
+// exact integer representation.
+func valueToInteger(L *lua.State, v reflect.Value) int64 {
+	switch unsizedKind(v) {
+	case reflect.Int64:
+		return v.Int()
+	case reflect.Uint64:
+		return int64(v.Uint())
+	}
+	f := valueToNumber(L, v)
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		L.RaiseError(fmt.Sprintf("number %v has no integer representation", f))
+	}
+	return int64(f)
+}
+
 func valueToNumber(L *lua.State, v reflect.Value) float64 {
 	switch unsizedKind(v) {
 	case reflect.Int64:
@@ -295,3 +1221,91 @@ func valueToString(L *lua.State, v reflect.Value) string {
 	L.RaiseError("cannot convert to string")
 	return ""
 }
+
+// valuesEqual compares 'a1' and 'a2' without panicking on uncomparable types.
+//
+// An 'Equal' or 'Compare' method has priority. Maps, functions and slices are compared by
+// identity. Other uncomparable values are compared with reflect.DeepEqual.
+func valuesEqual(a1, a2 interface{}) (eq bool) {
+	v1 := reflect.ValueOf(a1)
+	v2 := reflect.ValueOf(a2)
+	if !v1.IsValid() || !v2.IsValid() {
+		return v1.IsValid() == v2.IsValid()
+	}
+	if r, ok := callCompareMethod(v1, "Equal", v2); ok && r.Kind() == reflect.Bool {
+		return r.Bool()
+	}
+	if r, ok := callCompareMethod(v1, "Compare", v2); ok && unsizedKind(r) == reflect.Int64 {
+		return r.Int() == 0
+	}
+	if v1.Type() != v2.Type() {
+		return false
+	}
+
+	switch v1.Kind() {
+	case reflect.Func, reflect.Map:
+		return v1.Pointer() == v2.Pointer()
+	case reflect.Slice:
+		return v1.Pointer() == v2.Pointer() && v1.Len() == v2.Len()
+	}
+	if !v1.Type().Comparable() {
+		return reflect.DeepEqual(a1, a2)
+	}
+
+	// Comparable types can still hold uncomparable values in interface fields.
+	defer func() {
+		if x := recover(); x != nil {
+			eq = reflect.DeepEqual(a1, a2)
+		}
+	}()
+	return a1 == a2
+}
+
+// valuesLessDefault is the default ordering of slice elements: numbers and
+// strings use Go's '<' operator, other values use valuesLess.
+func valuesLessDefault(L *lua.State, v1, v2 reflect.Value) bool {
+	if v1.Kind() == reflect.Interface {
+		v1 = v1.Elem()
+	}
+	if v2.Kind() == reflect.Interface {
+		v2 = v2.Elem()
+	}
+	k1, k2 := unsizedKind(v1), unsizedKind(v2)
+	if k1 == reflect.String && k2 == reflect.String {
+		return v1.String() < v2.String()
+	}
+	switch commonKind(v1, v2) {
+	case reflect.Uint64:
+		return v1.Uint() < v2.Uint()
+	case reflect.Int64:
+		return v1.Int() < v2.Int()
+	case reflect.Float64:
+		if (k1 == reflect.Int64 || k1 == reflect.Uint64 || k1 == reflect.Float64) &&
+			(k2 == reflect.Int64 || k2 == reflect.Uint64 || k2 == reflect.Float64) {
+			return valueToNumber(L, v1) < valueToNumber(L, v2)
+		}
+	}
+	return valuesLess(L, v1, v2, false)
+}
+
+// valuesLess reports whether 'v1' is less than (or equal to if 'orEqual' is
+// set) 'v2' using a 'Compare' or 'Less' method of 'v1'.
+func valuesLess(L *lua.State, v1, v2 reflect.Value, orEqual bool) bool {
+	if r, ok := callCompareMethod(v1, "Compare", v2); ok && unsizedKind(r) == reflect.Int64 {
+		if orEqual {
+			return r.Int() <= 0
+		}
+		return r.Int() < 0
+	}
+	if r, ok := callCompareMethod(v1, "Less", v2); ok && r.Kind() == reflect.Bool {
+		if r.Bool() || !orEqual {
+			return r.Bool()
+		}
+		// a <= b is equivalent to not (b < a).
+		if r, ok = callCompareMethod(v2, "Less", v1); ok && r.Kind() == reflect.Bool {
+			return !r.Bool()
+		}
+	}
+	L.RaiseError(fmt.Sprintf("cannot compare %v with %v", v1.Type(), v2.Type()))
+	return false
+}
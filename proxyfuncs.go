@@ -3,11 +3,98 @@ package luar
 // Those functions are meant to be registered in Lua to manipulate proxies.
 
 import (
+	"fmt"
 	"reflect"
 
 	"github.com/aarzilli/golua/lua"
 )
 
+// ChanSelect performs a Go 'select' over channel proxies.
+//
+// Argument: cases (table)
+//
+// Each case is a table '{ch, "recv"}' or '{ch, "send", value}'. The optional
+// 'default' field makes the select non-blocking: if no case is ready,
+// 'default' is called when it is a function and its results are returned.
+//
+// Returns: index (number), value, ok (boolean)
+//
+// 'index' is the index of the chosen case. 'value' and 'ok' are only returned
+// for receive cases, with the same meaning as for the 'recv' method.
+func ChanSelect(L *lua.State) int {
+	L.CheckType(1, lua.LUA_TTABLE)
+	L.SetTop(1)
+	n := int(L.ObjLen(1))
+	cases := make([]reflect.SelectCase, 0, n+1)
+	proxies := make([]*valueProxy, 0, n)
+	for i := 1; i <= n; i++ {
+		L.RawGeti(1, i)
+		if !L.IsTable(-1) {
+			L.RaiseError(fmt.Sprintf("select: case %d is not a table", i))
+		}
+		L.RawGeti(-1, 1)
+		var ch reflect.Value
+		if isValueProxy(L, -1) {
+			p := proxyOf(L, -1)
+			proxies = append(proxies, p)
+			ch = reflect.Indirect(p.v)
+		}
+		if !ch.IsValid() || ch.Kind() != reflect.Chan {
+			L.RaiseError(fmt.Sprintf("select: case %d requires a channel", i))
+		}
+		L.Pop(1)
+
+		L.RawGeti(-1, 2)
+		dir := L.ToString(-1)
+		L.Pop(1)
+		switch dir {
+		case "recv":
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: ch})
+		case "send":
+			checkWritable(L, proxies[i-1], "channel send")
+			L.RawGeti(-1, 3)
+			val := reflect.New(ch.Type().Elem())
+			if err := LuaToGo(L, -1, val.Interface()); err != nil {
+				L.RaiseError(fmt.Sprintf("channel requires %v value type", ch.Type().Elem()))
+			}
+			L.Pop(1)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: ch, Send: val.Elem()})
+		default:
+			L.RaiseError(fmt.Sprintf(`select: case %d requires "recv" or "send"`, i))
+		}
+		L.Pop(1)
+	}
+
+	// The default case is left at index 2.
+	L.GetField(1, "default")
+	if !L.IsNil(2) {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	}
+
+	chosen, val, ok := reflect.Select(cases)
+	if chosen == n {
+		if !L.IsFunction(2) {
+			return 0
+		}
+		if err := L.Call(0, lua.LUA_MULTRET); err != nil {
+			L.RaiseError(err.Error())
+		}
+		return L.GetTop() - 1
+	}
+
+	L.PushInteger(int64(chosen + 1))
+	if cases[chosen].Dir != reflect.SelectRecv {
+		return 1
+	}
+	if ok {
+		pushNested(L, proxies[chosen], val)
+	} else {
+		L.PushNil()
+	}
+	L.PushBoolean(ok)
+	return 3
+}
+
 // Complex pushes a proxy to a Go complex on the stack.
 //
 // Arguments: real (number), imag (number)
@@ -42,6 +129,42 @@ func MakeMap(L *lua.State) int {
 	return 1
 }
 
+// MakeRef creates a reference proxy and pushes it on the stack.
+//
+// The reference points to a new Go value initialized with the argument. Its
+// type is not fixed until the reference is passed to a Go function, or
+// assigned to a Go value, expecting a pointer to a boolean, a number or a
+// string: the reference then points to a value of that type. This allows for
+// out-parameters:
+//
+//	n = luar.ref(0)
+//	count(items, n) -- func count(items []string, n *int)
+//	print(n.value)
+//
+// Optional argument: value (boolean, number or string)
+//
+// Returns: proxy (*bool, *float64, *string or *interface{})
+func MakeRef(L *lua.State) int {
+	var v reflect.Value
+	switch L.Type(1) {
+	case lua.LUA_TNONE, lua.LUA_TNIL:
+		v = reflect.New(reflect.TypeOf((*interface{})(nil)).Elem())
+	case lua.LUA_TBOOLEAN:
+		v = reflect.New(reflect.TypeOf(false))
+		v.Elem().SetBool(L.ToBoolean(1))
+	case lua.LUA_TNUMBER:
+		v = reflect.New(reflect.TypeOf(0.0))
+		v.Elem().SetFloat(L.ToNumber(1))
+	case lua.LUA_TSTRING:
+		v = reflect.New(reflect.TypeOf(""))
+		v.Elem().SetString(L.ToString(1))
+	default:
+		L.RaiseError("ref requires a boolean, number or string")
+	}
+	makeProxy(L, &valueProxy{v: v, t: v.Type(), untyped: true}, cRefMeta)
+	return 1
+}
+
 // MakeSlice creates a '[]interface{}' proxy and pushes it on the stack.
 //
 // Optional argument: size (number)
@@ -54,6 +177,24 @@ func MakeSlice(L *lua.State) int {
 	return 1
 }
 
+// ProxyFields is like 'pairs' for struct proxies, optionally including the
+// methods after the fields.
+//
+// Arguments: proxy (struct), withMethods (boolean, optional)
+//
+// Returns: iterator (function)
+func ProxyFields(L *lua.State) int {
+	if !isValueProxy(L, 1) {
+		L.RaiseError("fields requires a struct proxy")
+	}
+	p := proxyOf(L, 1)
+	if reflect.Indirect(p.v).Kind() != reflect.Struct {
+		L.RaiseError(fmt.Sprintf("fields requires a struct proxy, got %v", p.t))
+	}
+	structPairs(L, p, L.ToBoolean(2))
+	return 1
+}
+
 func ipairsAux(L *lua.State) int {
 	i := L.CheckInteger(2) + 1
 	L.PushInteger(int64(i))
@@ -118,6 +259,9 @@ func RegProxyIpairs(L *lua.State, table, name string) {
 
 // ProxyMethod pushes the proxy method on the stack.
 //
+// It is the only way to get the methods luar provides for map proxies, so that
+// they do not collide with the keys. Go methods have priority over them.
+//
 // Argument: proxy
 //
 // Returns: method (function)
@@ -126,9 +270,13 @@ func ProxyMethod(L *lua.State) int {
 		L.PushNil()
 		return 1
 	}
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
 	name := L.ToString(2)
-	pushGoMethod(L, name, v)
+	pushGoMethod(L, name, p.v, p)
+	if L.IsNil(-1) && reflect.Indirect(p.v).Kind() == reflect.Map {
+		L.Pop(1)
+		pushMapMethod(L, p, name)
+	}
 	return 1
 }
 
@@ -151,6 +299,47 @@ func ProxyPairs(L *lua.State) int {
 	return 3
 }
 
+// ProxyPcall implements Lua's 'pcall' function so that it also catches the
+// errors raised by Go functions.
+//
+// When a Go function panics with an error, the error value is a proxy of the
+// original Go error, with its 'Error' method. If such a proxy is raised again
+// and propagates out of LuaObject.Call, the returned error wraps the original
+// error. Other errors are returned as they were raised.
+//
+// Arguments: function, args...
+//
+// Returns: status (boolean), results... or error
+func ProxyPcall(L *lua.State) int {
+	L.CheckAny(1)
+	err := L.Call(L.GetTop()-1, lua.LUA_MULTRET)
+	if err != nil {
+		if gerr, ok := err.(*goError); ok {
+			L.SetTop(0)
+			L.PushBoolean(false)
+			makeValueProxy(L, reflect.ValueOf(gerr.err), cInterfaceMeta)
+			return 2
+		}
+		if lerr, ok := err.(*lua.LuaError); ok && lerr.Code() != 0 {
+			// The Lua error value is on top of the stack.
+			L.Replace(1)
+			L.SetTop(1)
+			L.PushBoolean(false)
+			L.Insert(1)
+			return 2
+		}
+		// Errors raised from Go with L.RaiseError leave no value on the
+		// stack.
+		L.SetTop(0)
+		L.PushBoolean(false)
+		L.PushString(err.Error())
+		return 2
+	}
+	L.PushBoolean(true)
+	L.Insert(1)
+	return L.GetTop()
+}
+
 // ProxyType pushes the proxy type on the stack.
 //
 // It behaves like Lua's "type" except for proxies for which it returns
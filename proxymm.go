@@ -13,49 +13,135 @@ import (
 	"math"
 	"math/cmplx"
 	"reflect"
+	"time"
 
 	"github.com/aarzilli/golua/lua"
 )
 
 func channel__index(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v, t := p.v, p.t
+	self := L.ToPointer(1)
 	name := L.ToString(2)
+	// pushRecv pushes the received value and the 'ok' flag.
+	pushRecv := func(L *lua.State, val reflect.Value, ok bool) int {
+		if ok {
+			pushNested(L, p, val)
+		} else {
+			L.PushNil()
+		}
+		L.PushBoolean(ok)
+		return 2
+	}
+	// toElem converts the argument at 'idx' to a channel element.
+	toElem := func(L *lua.State, idx int) reflect.Value {
+		val := reflect.New(t.Elem())
+		err := LuaToGo(L, idx, val.Interface())
+		if err != nil {
+			L.RaiseError(fmt.Sprintf("channel requires %v value type", t.Elem()))
+		}
+		return val.Elem()
+	}
 	switch name {
 	case "recv":
 		f := func(L *lua.State) int {
 			val, ok := v.Recv()
-			if ok {
-				GoToLuaProxy(L, val)
-				return 1
+			return pushRecv(L, val, ok)
+		}
+		L.PushGoFunction(f)
+	case "recv_timeout":
+		f := func(L *lua.State) int {
+			d := time.Duration(L.CheckNumber(methodArgs(L, self)) * float64(time.Second))
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			chosen, val, ok := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: v},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+			})
+			if chosen == 1 {
+				// Timed out: 'ok' is nil.
+				L.PushNil()
+				L.PushNil()
+				return 2
 			}
-			return 0
+			return pushRecv(L, val, ok)
 		}
 		L.PushGoFunction(f)
 	case "send":
 		f := func(L *lua.State) int {
-			val := reflect.New(t.Elem())
-			err := LuaToGo(L, 1, val.Interface())
-			if err != nil {
-				L.RaiseError(fmt.Sprintf("channel requires %v value type", t.Elem()))
-			}
-			v.Send(val.Elem())
+			checkWritable(L, p, "channel send")
+			v.Send(toElem(L, methodArgs(L, self)))
 			return 0
 		}
 		L.PushGoFunction(f)
+	case "try_recv":
+		f := func(L *lua.State) int {
+			val, ok := v.TryRecv()
+			if !val.IsValid() {
+				// Would block: 'ok' is nil.
+				L.PushNil()
+				L.PushNil()
+				return 2
+			}
+			return pushRecv(L, val, ok)
+		}
+		L.PushGoFunction(f)
+	case "try_send":
+		f := func(L *lua.State) int {
+			checkWritable(L, p, "channel send")
+			L.PushBoolean(v.TrySend(toElem(L, methodArgs(L, self))))
+			return 1
+		}
+		L.PushGoFunction(f)
+	case "values":
+		f := func(L *lua.State) int {
+			L.PushGoFunction(func(L *lua.State) int {
+				val, ok := v.Recv()
+				if !ok {
+					return 0
+				}
+				pushNested(L, p, val)
+				return 1
+			})
+			return 1
+		}
+		L.PushGoFunction(f)
 	case "close":
 		f := func(L *lua.State) int {
+			checkWritable(L, p, "channel close")
 			v.Close()
 			return 0
 		}
 		L.PushGoFunction(f)
 	default:
-		pushGoMethod(L, name, v)
+		pushGoMethod(L, name, v, p)
 	}
 	return 1
 }
 
+// Channels are iterated like Go's 'for v := range ch': each iteration receives
+// a value until the channel is closed. The index counts the received values.
+func channel__ipairs(L *lua.State) int {
+	p := proxyOf(L, 1)
+	v := p.v
+	idx := 0
+	iter := func(L *lua.State) int {
+		val, ok := v.Recv()
+		if !ok {
+			return 0
+		}
+		idx++
+		L.PushInteger(int64(idx))
+		pushNested(L, p, val)
+		return 2
+	}
+	L.PushGoFunction(iter)
+	return 1
+}
+
 func complex__index(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	name := L.ToString(2)
 	switch name {
 	case "real":
@@ -63,34 +149,35 @@ func complex__index(L *lua.State) int {
 	case "imag":
 		L.PushNumber(imag(v.Complex()))
 	default:
-		pushGoMethod(L, name, v)
+		pushGoMethod(L, name, v, p)
 	}
 	return 1
 }
 
 func interface__index(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
 	name := L.ToString(2)
-	pushGoMethod(L, name, v)
+	pushGoMethod(L, name, p.v, p)
 	return 1
 }
 
 // TODO: Should map[string] and struct allow direct method calls? Check if first letter is uppercase?
 func map__index(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v, t := p.v, p.t
 	key := reflect.New(t.Key())
 	err := LuaToGo(L, 2, key.Interface())
 	if err == nil {
 		key = key.Elem()
 		val := v.MapIndex(key)
 		if val.IsValid() {
-			GoToLuaProxy(L, val)
+			pushMapValue(L, p, v, key, val)
 			return 1
 		}
 	}
 	if !L.IsNumber(2) && L.IsString(2) {
 		name := L.ToString(2)
-		pushGoMethod(L, name, v)
+		pushGoMethod(L, name, v, p)
 		return 1
 	}
 	if err != nil {
@@ -100,7 +187,8 @@ func map__index(L *lua.State) int {
 }
 
 func map__ipairs(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	keys := v.MapKeys()
 	intKeys := map[uint64]reflect.Value{}
 
@@ -127,8 +215,9 @@ func map__ipairs(L *lua.State) int {
 			return 0
 		}
 		GoToLuaProxy(L, idx)
-		val := v.MapIndex(intKeys[idx])
-		GoToLuaProxy(L, val)
+		key := intKeys[idx]
+		val := v.MapIndex(key)
+		pushMapValue(L, p, v, key, val)
 		return 2
 	}
 	L.PushGoFunction(iter)
@@ -136,7 +225,9 @@ func map__ipairs(L *lua.State) int {
 }
 
 func map__newindex(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	checkWritable(L, p, "map set")
+	v, t := p.v, p.t
 	key := reflect.New(t.Key())
 	err := LuaToGo(L, 2, key.Interface())
 	if err != nil {
@@ -149,12 +240,18 @@ func map__newindex(L *lua.State) int {
 		L.RaiseError(fmt.Sprintf("map requires %v value type", t.Elem()))
 	}
 	val = val.Elem()
+	if L.IsNil(3) {
+		// Assigning nil deletes the key, as in Lua.
+		val = reflect.Value{}
+	}
 	v.SetMapIndex(key, val)
+	storeBack(p)
 	return 0
 }
 
 func map__pairs(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	keys := v.MapKeys()
 	idx := -1
 	n := v.Len()
@@ -163,9 +260,10 @@ func map__pairs(L *lua.State) int {
 		if idx == n {
 			return 0
 		}
-		GoToLuaProxy(L, keys[idx])
-		val := v.MapIndex(keys[idx])
-		GoToLuaProxy(L, val)
+		key := keys[idx]
+		pushNested(L, p, key)
+		val := v.MapIndex(key)
+		pushMapValue(L, p, v, key, val)
 		return 2
 	}
 	L.PushGoFunction(iter)
@@ -190,6 +288,57 @@ func number__add(L *lua.State) int {
 	return 1
 }
 
+func number__band(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, t2 := luaToGoValue(L, 2)
+	var result interface{}
+	if integerKind(v1, v2) == reflect.Uint64 {
+		result = v1.Uint() & v2.Uint()
+	} else {
+		result = valueToInteger(L, v1) & valueToInteger(L, v2)
+	}
+	pushOperatorValue(L, result, t1, t2)
+	return 1
+}
+
+func number__bnot(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	var result interface{}
+	if unsizedKind(v1) == reflect.Uint64 {
+		result = ^v1.Uint()
+	} else {
+		result = ^valueToInteger(L, v1)
+	}
+	pushOperatorValue(L, result, t1, t1)
+	return 1
+}
+
+func number__bor(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, t2 := luaToGoValue(L, 2)
+	var result interface{}
+	if integerKind(v1, v2) == reflect.Uint64 {
+		result = v1.Uint() | v2.Uint()
+	} else {
+		result = valueToInteger(L, v1) | valueToInteger(L, v2)
+	}
+	pushOperatorValue(L, result, t1, t2)
+	return 1
+}
+
+func number__bxor(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, t2 := luaToGoValue(L, 2)
+	var result interface{}
+	if integerKind(v1, v2) == reflect.Uint64 {
+		result = v1.Uint() ^ v2.Uint()
+	} else {
+		result = valueToInteger(L, v1) ^ valueToInteger(L, v2)
+	}
+	pushOperatorValue(L, result, t1, t2)
+	return 1
+}
+
 func number__div(L *lua.State) int {
 	v1, t1 := luaToGoValue(L, 1)
 	v2, t2 := luaToGoValue(L, 2)
@@ -208,6 +357,51 @@ func number__div(L *lua.State) int {
 	return 1
 }
 
+// Integer division truncates towards zero as in Go. This includes an integer
+// proxy divided by an integral Lua number. Float division is floored as in Lua.
+func number__idiv(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, t2 := luaToGoValue(L, 2)
+	kind := commonKind(v1, v2)
+	if kind == reflect.Float64 && (isIntegerValue(v1) || isIntegerValue(v2)) && isIntegral(v1) && isIntegral(v2) {
+		kind = reflect.Int64
+	}
+	var result interface{}
+	switch kind {
+	case reflect.Uint64:
+		if v2.Uint() == 0 {
+			L.RaiseError("integer divide by zero")
+		}
+		result = v1.Uint() / v2.Uint()
+	case reflect.Int64:
+		d := valueToInteger(L, v2)
+		if d == 0 {
+			L.RaiseError("integer divide by zero")
+		}
+		result = valueToInteger(L, v1) / d
+	case reflect.Float64:
+		result = math.Floor(valueToNumber(L, v1) / valueToNumber(L, v2))
+	default:
+		L.RaiseError("integer division is not supported on complex numbers")
+	}
+	pushOperatorValue(L, result, t1, t2)
+	return 1
+}
+
+func number__le(L *lua.State) int {
+	v1, _ := luaToGoValue(L, 1)
+	v2, _ := luaToGoValue(L, 2)
+	switch commonKind(v1, v2) {
+	case reflect.Uint64:
+		L.PushBoolean(v1.Uint() <= v2.Uint())
+	case reflect.Int64:
+		L.PushBoolean(v1.Int() <= v2.Int())
+	case reflect.Float64:
+		L.PushBoolean(valueToNumber(L, v1) <= valueToNumber(L, v2))
+	}
+	return 1
+}
+
 func number__lt(L *lua.State) int {
 	v1, _ := luaToGoValue(L, 1)
 	v2, _ := luaToGoValue(L, 2)
@@ -274,6 +468,36 @@ func number__pow(L *lua.State) int {
 	return 1
 }
 
+func number__shl(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, _ := luaToGoValue(L, 2)
+	n := shiftCount(L, v2)
+	var result interface{}
+	if unsizedKind(v1) == reflect.Uint64 {
+		result = v1.Uint() << n
+	} else {
+		result = valueToInteger(L, v1) << n
+	}
+	// As in Go, the type of a shift is the type of its left operand.
+	pushOperatorValue(L, result, t1, t1)
+	return 1
+}
+
+func number__shr(L *lua.State) int {
+	v1, t1 := luaToGoValue(L, 1)
+	v2, _ := luaToGoValue(L, 2)
+	n := shiftCount(L, v2)
+	var result interface{}
+	if unsizedKind(v1) == reflect.Uint64 {
+		result = v1.Uint() >> n
+	} else {
+		result = valueToInteger(L, v1) >> n
+	}
+	// As in Go, the type of a shift is the type of its left operand.
+	pushOperatorValue(L, result, t1, t1)
+	return 1
+}
+
 func number__sub(L *lua.State) int {
 	v1, t1 := luaToGoValue(L, 1)
 	v2, t2 := luaToGoValue(L, 2)
@@ -319,14 +543,14 @@ func number__unm(L *lua.State) int {
 // From Lua's specs: "A metamethod only is selected when both objects being
 // compared have the same type and the same metamethod for the selected
 // operation." Thus both arguments must be proxies for this function to be
-// called. No need to check for type equality: Go's "==" operator will do it for
-// us.
+// called. Values of different types are never equal unless the type has an
+// 'Equal' method accepting the other operand.
 func proxy__eq(L *lua.State) int {
 	var a1 interface{}
 	_ = LuaToGo(L, 1, &a1)
 	var a2 interface{}
 	_ = LuaToGo(L, 2, &a2)
-	L.PushBoolean(a1 == a2)
+	L.PushBoolean(valuesEqual(a1, a2))
 	return 1
 }
 
@@ -338,14 +562,62 @@ func proxy__gc(L *lua.State) int {
 	return 0
 }
 
+func proxy__le(L *lua.State) int {
+	v1, _ := valueOfProxy(L, 1)
+	v2, _ := valueOfProxy(L, 2)
+	L.PushBoolean(valuesLess(L, v1, v2, true))
+	return 1
+}
+
+func proxy__lt(L *lua.State) int {
+	v1, _ := valueOfProxy(L, 1)
+	v2, _ := valueOfProxy(L, 2)
+	L.PushBoolean(valuesLess(L, v1, v2, false))
+	return 1
+}
+
 func proxy__tostring(L *lua.State) int {
 	v, _ := valueOfProxy(L, 1)
 	L.PushString(fmt.Sprintf("%v", v))
 	return 1
 }
 
+func ref__index(L *lua.State) int {
+	p := proxyOf(L, 1)
+	self := L.ToPointer(1)
+	name := L.ToString(2)
+	switch name {
+	case "value":
+		pushRefValue(L, p)
+	case "get":
+		L.PushGoFunction(func(L *lua.State) int {
+			pushRefValue(L, p)
+			return 1
+		})
+	case "set":
+		L.PushGoFunction(func(L *lua.State) int {
+			setRefValue(L, p, methodArgs(L, self))
+			return 0
+		})
+	default:
+		pushGoMethod(L, name, p.v, p)
+	}
+	return 1
+}
+
+func ref__newindex(L *lua.State) int {
+	p := proxyOf(L, 1)
+	name := L.ToString(2)
+	if name != "value" {
+		L.RaiseError(fmt.Sprintf("ref set: invalid field %q", name))
+	}
+	setRefValue(L, p, 3)
+	return 0
+}
+
 func slice__index(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	for v.Kind() == reflect.Ptr {
 		// For arrays.
 		v = v.Elem()
@@ -356,17 +628,18 @@ func slice__index(L *lua.State) int {
 			L.RaiseError("slice/array get: index out of range")
 		}
 		v := v.Index(idx - 1)
-		GoToLuaProxy(L, v)
+		pushNested(L, p, v)
 
 	} else if L.IsString(2) {
 		name := L.ToString(2)
 		if v.Kind() == reflect.Array {
-			pushGoMethod(L, name, v)
+			pushGoMethod(L, name, v, p)
 			return 1
 		}
 		switch name {
 		case "append":
 			f := func(L *lua.State) int {
+				checkWritable(L, p, "slice append")
 				narg := L.GetTop()
 				args := []reflect.Value{}
 				for i := 1; i <= narg; i++ {
@@ -385,9 +658,11 @@ func slice__index(L *lua.State) int {
 		case "cap":
 			L.PushInteger(int64(v.Cap()))
 		case "slice":
-			L.PushGoFunction(slicer(L, v, cSliceMeta))
+			L.PushGoFunction(slicer(L, p, v, cSliceMeta))
 		default:
-			pushGoMethod(L, name, v)
+			if !pushSliceMethod(L, p, v, L.ToPointer(1), name) {
+				pushGoMethod(L, name, v, p)
+			}
 		}
 	} else {
 		L.RaiseError("non-integer slice/array index")
@@ -396,7 +671,8 @@ func slice__index(L *lua.State) int {
 }
 
 func slice__ipairs(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	for v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
@@ -409,7 +685,7 @@ func slice__ipairs(L *lua.State) int {
 		}
 		GoToLuaProxy(L, idx+1) // report as 1-based index
 		val := v.Index(idx)
-		GoToLuaProxy(L, val)
+		pushNested(L, p, val)
 		return 2
 	}
 	L.PushGoFunction(iter)
@@ -417,7 +693,9 @@ func slice__ipairs(L *lua.State) int {
 }
 
 func slice__newindex(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	checkWritable(L, p, "slice/array set")
+	v, t := p.v, p.t
 	for v.Kind() == reflect.Ptr {
 		// For arrays.
 		v = v.Elem()
@@ -430,10 +708,17 @@ func slice__newindex(L *lua.State) int {
 		L.RaiseError(fmt.Sprintf("slice requires %v value type", t.Elem()))
 	}
 	val = val.Elem()
+	if idx == v.Len()+1 && v.Kind() == reflect.Slice && v.CanSet() {
+		// Settable slices grow like Lua arrays: the new header is written back.
+		v.Set(reflect.Append(v, val))
+		storeBack(p)
+		return 0
+	}
 	if idx < 1 || idx > v.Len() {
 		L.RaiseError("slice/array set: index out of range")
 	}
 	v.Index(idx - 1).Set(val)
+	storeBack(p)
 	return 0
 }
 
@@ -469,7 +754,8 @@ func string__concat(L *lua.State) int {
 }
 
 func string__index(L *lua.State) int {
-	v, _ := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v := p.v
 	if L.IsNumber(2) {
 		idx := L.ToInteger(2)
 		if idx < 1 || idx > v.Len() {
@@ -479,10 +765,16 @@ func string__index(L *lua.State) int {
 		GoToLuaProxy(L, v)
 	} else if L.IsString(2) {
 		name := L.ToString(2)
-		if name == "slice" {
-			L.PushGoFunction(slicer(L, v, cStringMeta))
-		} else {
-			pushGoMethod(L, name, v)
+		switch name {
+		case "slice":
+			L.PushGoFunction(slicer(L, p, v, cStringMeta))
+		case "bytes", "runelen", "runes", "runeslice":
+			pushStringUTF8Method(L, p, L.ToPointer(1), name)
+		default:
+			pushGoMethod(L, name, v, p)
+			if L.IsNil(-1) && pushStringMethod(L, p, L.ToPointer(1), name) {
+				L.Remove(-2)
+			}
 		}
 	} else {
 		L.RaiseError("non-integer string index")
@@ -517,6 +809,13 @@ func string__len(L *lua.State) int {
 	return 1
 }
 
+func string__le(L *lua.State) int {
+	v1, _ := luaToGoValue(L, 1)
+	v2, _ := luaToGoValue(L, 2)
+	L.PushBoolean(v1.String() <= v2.String())
+	return 1
+}
+
 func string__lt(L *lua.State) int {
 	v1, _ := luaToGoValue(L, 1)
 	v2, _ := luaToGoValue(L, 2)
@@ -525,30 +824,33 @@ func string__lt(L *lua.State) int {
 }
 
 func struct__index(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	v, t := p.v, p.t
 	name := L.ToString(2)
 	vp := v
 	if t.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
-	field := v.FieldByName(name)
-	if !field.IsValid() || !field.CanSet() {
+	field, fieldName := structFieldByKey(v, name)
+	if !field.IsValid() || !field.CanSet() || !isMemberAccessible(v.Type(), fieldName) {
 		// No such exported field, try for method.
-		pushGoMethod(L, name, vp)
+		pushGoMethod(L, name, vp, p)
 	} else {
-		GoToLuaProxy(L, field)
+		pushNested(L, p, field)
 	}
 	return 1
 }
 
 func struct__newindex(L *lua.State) int {
-	v, t := valueOfProxy(L, 1)
+	p := proxyOf(L, 1)
+	checkWritable(L, p, "struct set")
+	v, t := p.v, p.t
 	name := L.ToString(2)
 	if t.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
-	field := v.FieldByName(name)
-	if !field.IsValid() {
+	field, name := structFieldByKey(v, name)
+	if !field.IsValid() || !isMemberAccessible(v.Type(), name) {
 		L.RaiseError(fmt.Sprintf("no field named `%s` for type %s", name, v.Type()))
 	}
 	val := reflect.New(field.Type())
@@ -557,5 +859,11 @@ func struct__newindex(L *lua.State) int {
 		L.RaiseError(fmt.Sprintf("struct field %v requires %v value type, error with target: %v", name, field.Type(), err))
 	}
 	field.Set(val.Elem())
+	storeBack(p)
 	return 0
 }
+
+func struct__pairs(L *lua.State) int {
+	structPairs(L, proxyOf(L, 1), false)
+	return 1
+}
@@ -0,0 +1,276 @@
+package luar
+
+// Automatic release and leak reports of LuaObjects and Coroutines.
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// OpenLuaObject describes a LuaObject or a Coroutine which has not been closed,
+// as reported by OpenLuaObjects.
+type OpenLuaObject struct {
+	// Ref is the registry reference held by the object.
+	Ref int
+	// Type is the Lua type of the referenced value.
+	Type string
+	// Caller is the location of the Go code which created the object, as
+	// "file:line".
+	Caller string
+}
+
+// objectTracker records the registry references of the LuaObjects and
+// Coroutines of a state. Finalizers only access the fields guarded by 'mu', the
+// other fields are only accessed by the goroutine running the state.
+type objectTracker struct {
+	release bool
+	track   bool
+	open    map[int]string
+
+	mu sync.Mutex
+	// released holds the references of the garbage-collected objects.
+	released []int
+	// live counts the objects with a finalizer which have not been released.
+	live int
+	// forgotten is set by ForgetObjects.
+	forgotten bool
+}
+
+// finalize enqueues the reference of a garbage-collected object.
+func (t *objectTracker) finalize(ref int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.forgotten {
+		t.released = append(t.released, ref)
+	}
+}
+
+// flush releases the references of the garbage-collected objects.
+func (t *objectTracker) flush(L *lua.State) {
+	t.mu.Lock()
+	released := t.released
+	t.released = nil
+	t.live -= len(released)
+	t.mu.Unlock()
+	for _, ref := range released {
+		L.Unref(lua.LUA_REGISTRYINDEX, ref)
+		delete(t.open, ref)
+	}
+}
+
+// unused reports whether the tracker can be dropped: both options are disabled
+// and no object is waiting for its finalizer.
+func (t *objectTracker) unused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.release && !t.track && t.live == 0
+}
+
+// Registry field of the userdata dropping the tracker of a state when the state
+// is closed.
+const cTrackerGuard = "luar.trackerguard"
+
+var (
+	trackers   = map[*lua.State]*objectTracker{}
+	trackersmu sync.Mutex
+
+	luarPkgPath = reflect.TypeOf(LuaObject{}).PkgPath()
+)
+
+// ForgetObjects stops the automatic release and the leak tracking of L, and
+// drops all the bookkeeping of L. It is called when L is closed. The references
+// of the objects which have not been closed are not released.
+func ForgetObjects(L *lua.State) {
+	trackersmu.Lock()
+	t := trackers[L]
+	delete(trackers, L)
+	trackersmu.Unlock()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.forgotten = true
+	t.released = nil
+	t.mu.Unlock()
+}
+
+// OpenLuaObjects returns the LuaObjects and Coroutines of L created while leak
+// tracking was enabled and not closed or released since, ordered by reference.
+// See SetLeakTracking.
+func OpenLuaObjects(L *lua.State) []OpenLuaObject {
+	t := trackerOf(L)
+	if t == nil {
+		return nil
+	}
+	t.flush(L)
+	var objects []OpenLuaObject
+	for ref, caller := range t.open {
+		L.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+		objects = append(objects, OpenLuaObject{Ref: ref, Type: L.LTypename(-1), Caller: caller})
+		L.Pop(1)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Ref < objects[j].Ref })
+	return objects
+}
+
+// SetAutoRelease enables or disables the automatic release of the LuaObjects
+// and Coroutines of L created from now on, including the ones created
+// implicitly by LuaToGo.
+//
+// The reference of an object which is garbage-collected without having been
+// closed is released on the next call to NewLuaObject or to a LuaObject or
+// Coroutine method on L. Since finalizers run at the discretion of the Go
+// runtime, Close should still be preferred to release references in time.
+//
+// Objects created while it was enabled are still released once it is
+// disabled. The bookkeeping of L is dropped when L is closed, see
+// ForgetObjects.
+func SetAutoRelease(L *lua.State, enabled bool) {
+	t := newTracker(L)
+	t.release = enabled
+	releaseObjects(L)
+}
+
+// SetLeakTracking enables or disables the recording of the LuaObjects and
+// Coroutines of L created from now on, to be reported by OpenLuaObjects.
+// Recording includes the location of the creation, which makes these objects
+// more expensive to create.
+//
+// Disabling leak tracking forgets the objects recorded so far. The bookkeeping
+// of L is dropped when L is closed, see ForgetObjects.
+func SetLeakTracking(L *lua.State, enabled bool) {
+	t := newTracker(L)
+	t.track = enabled
+	if enabled && t.open == nil {
+		t.open = map[int]string{}
+	} else if !enabled {
+		t.open = nil
+	}
+	releaseObjects(L)
+}
+
+// callerOutsideLuar returns the location of the first caller outside of the
+// luar package, or of the direct caller of luar if there is none.
+func callerOutsideLuar() string {
+	pc := make([]uintptr, 32)
+	// Skip runtime.Callers, callerOutsideLuar and trackRef.
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	first := ""
+	for {
+		frame, more := frames.Next()
+		location := fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		if first == "" {
+			first = location
+		}
+		if !strings.HasPrefix(frame.Function, luarPkgPath+".") || strings.HasSuffix(frame.File, "_test.go") {
+			return location
+		}
+		if !more {
+			return first
+		}
+	}
+}
+
+// guardTracker makes closing L call ForgetObjects: the registry of L holds a
+// userdata whose '__gc' metamethod runs when L is closed.
+func guardTracker(L *lua.State) {
+	L.GetField(lua.LUA_REGISTRYINDEX, cTrackerGuard)
+	guarded := !L.IsNil(-1)
+	L.Pop(1)
+	if guarded {
+		return
+	}
+	// Lua finalizes userdata in the reverse order of creation: create the Go
+	// function, itself a userdata, first so that it is still valid when the
+	// guard is finalized.
+	L.PushGoFunction(func(*lua.State) int {
+		ForgetObjects(L)
+		return 0
+	})
+	L.NewUserdata(1)
+	L.CreateTable(0, 1)
+	L.PushValue(-3)
+	L.SetField(-2, "__gc")
+	L.SetMetaTable(-2)
+	L.SetField(lua.LUA_REGISTRYINDEX, cTrackerGuard)
+	L.Pop(1)
+}
+
+// newTracker returns the tracker of L, creating it if needed.
+func newTracker(L *lua.State) *objectTracker {
+	trackersmu.Lock()
+	t := trackers[L]
+	if t == nil {
+		t = &objectTracker{}
+		trackers[L] = t
+	}
+	trackersmu.Unlock()
+	guardTracker(L)
+	return t
+}
+
+// releaseObjects releases the references of the garbage-collected objects of
+// L, and drops the tracker of L once it is unused.
+func releaseObjects(L *lua.State) {
+	t := trackerOf(L)
+	if t == nil {
+		return
+	}
+	t.flush(L)
+	if t.unused() {
+		trackersmu.Lock()
+		if trackers[L] == t {
+			delete(trackers, L)
+		}
+		trackersmu.Unlock()
+	}
+}
+
+// trackRef records the new reference 'ref' of an object of L in the tracker of
+// L, if any. It returns the tracker if the reference must be released by the
+// finalizer of the object, nil otherwise.
+func trackRef(L *lua.State, ref int) *objectTracker {
+	t := trackerOf(L)
+	if t == nil {
+		return nil
+	}
+	t.flush(L)
+	if t.track {
+		t.open[ref] = callerOutsideLuar()
+	}
+	if !t.release {
+		return nil
+	}
+	t.mu.Lock()
+	t.live++
+	t.mu.Unlock()
+	return t
+}
+
+// trackerOf returns the tracker of L, or nil if none.
+func trackerOf(L *lua.State) *objectTracker {
+	trackersmu.Lock()
+	defer trackersmu.Unlock()
+	return trackers[L]
+}
+
+// untrackRef forgets the reference 'ref' of a closed object of L. 'owner' is
+// the tracker returned by trackRef for the object.
+func untrackRef(L *lua.State, ref int, owner *objectTracker) {
+	if owner != nil {
+		owner.mu.Lock()
+		owner.live--
+		owner.mu.Unlock()
+	}
+	if t := trackerOf(L); t != nil {
+		delete(t.open, ref)
+		releaseObjects(L)
+	}
+}